@@ -15,6 +15,9 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -28,31 +31,313 @@ import (
 
 func usage(p string) {
 	panic(fmt.Sprintf(`Usage: 
-	%s build [--dry] --env $ENV
-	%s registry --env $ENV
-	%s predicate --artifact-name $NAME --digest $DIGEST --command $COMMAND --env $ENV`, p, p, p))
+	%s build [--dry | --capture] [--date $DATE] [--envs $ENVS | --envs-list $ENVS_LIST] [--args $ARGS | --args-list $ARGS_LIST]
+	%s registry [--envs $ENVS | --envs-list $ENVS_LIST]
+	%s build-and-attest [--mode per-image|combined] [--format predicate|statement] [--slsa-version 0.2|1.0] [--go-module-dir $DIR] [--base-images none|warn|fail] [--oidc-issuer $URL] [--oidc-jwks-file $PATH] [--id-token-file $PATH [--key $KEY_PATH] | --key $KEY_PATH | --keyless [--fulcio-url $URL]] [--tlog-upload [--rekor-url $URL --rekor-public-key $PATH]] [--attach cosign|referrer|both] [--envs $ENVS | --envs-list $ENVS_LIST] [--args $ARGS | --args-list $ARGS_LIST]
+	%s predicate (--artifact-name $NAME --digest $DIGEST | --image $IMAGE | --images $IMAGES) [--mode per-image|combined] [--format predicate|statement] [--slsa-version 0.2|1.0] [--go-module-dir $DIR] [--base-images none|warn|fail] [--ko-version $VERSION] [--ko-config $KO_CONFIG] [--oidc-issuer $URL] [--oidc-jwks-file $PATH] [--id-token-file $PATH [--key $KEY_PATH] | --key $KEY_PATH | --keyless [--fulcio-url $URL]] [--tlog-upload [--rekor-url $URL --rekor-public-key $PATH]] [--attach cosign|referrer|both] --command $COMMAND --env $ENV
+	%s verify --image $IMAGE [--attestation $PATH [--certificate $PATH] [--bundle $PATH]] (--key $PUBLIC_KEY_PATH | --ca-roots $ROOTS_PATH [--certificate-oidc-issuer $URL]) [--rekor-public-key $PATH] --builder-id $BUILDER_ID --source-uri $URI [--source-ref $REF]`, p, p, p, p, p))
 }
 
+const (
+	// Exit code of the registry command when the registry, or the env
+	// variables it is read from, are invalid.
+	exitCodeInvalidRegistry = 3
+	// Exit code of the verify command when the verification fails.
+	exitCodeVerificationFailed = 4
+)
+
 func check(e error) {
 	if e != nil {
 		panic(e)
 	}
 }
 
+// setKoArgs sets the arguments and env variables of ko,
+// each of which may be passed in one of two encodings.
+func setKoArgs(kobuild *pkg.KoBuild, args, argsList, envs, envsList string) {
+	var err error
+
+	// Set arguments.
+	if args != "" && argsList != "" {
+		usage(os.Args[0])
+	}
+	if argsList != "" {
+		err = kobuild.SetArgsList(argsList)
+	} else {
+		err = kobuild.SetArgs(args)
+	}
+	check(err)
+
+	// Set env variables encoded as arguments.
+	if envs != "" && envsList != "" {
+		usage(os.Args[0])
+	}
+	if envsList != "" {
+		err = kobuild.SetArgEnvVariablesList(envsList)
+	} else {
+		err = kobuild.SetArgEnvVariables(envs)
+	}
+	check(err)
+}
+
+func getGitHubContext() string {
+	githubContext, ok := os.LookupEnv("GITHUB_CONTEXT")
+	if !ok {
+		panic(errors.New("environment variable GITHUB_CONTEXT not present"))
+	}
+	return githubContext
+}
+
+// signingFlags select how the statements are signed and published, if at all,
+// and where the workflow's OIDC token comes from.
+type signingFlags struct {
+	idTokenFile *string
+	oidcIssuer  *string
+	oidcJWKS    *string
+	key         *string
+	keyless     *bool
+	fulcioURL   *string
+	tlogUpload  *bool
+	rekorURL    *string
+	rekorKey    *string
+	attach      *string
+}
+
+func addSigningFlags(fs *flag.FlagSet) signingFlags {
+	return signingFlags{
+		idTokenFile: fs.String("id-token-file", "", "path to a file holding the workflow's OIDC token, instead of requesting it from the GitHub Actions runtime; not usable with --keyless"),
+		oidcIssuer:  fs.String("oidc-issuer", "", "URL of the issuer the OIDC token is verified against (default GitHub Actions' issuer)"),
+		oidcJWKS:    fs.String("oidc-jwks-file", "", "path to the issuer's JWKS, instead of fetching it from the issuer"),
+		key:         fs.String("key", "", "path to a private key to sign the statements with, decrypted by $COSIGN_PASSWORD if needed"),
+		keyless:     fs.Bool("keyless", false, "sign the statements with a Fulcio certificate for the workflow's OIDC identity"),
+		fulcioURL:   fs.String("fulcio-url", "", "URL of the Fulcio instance used by --keyless (default the public instance)"),
+		tlogUpload:  fs.Bool("tlog-upload", false, "upload the signed statements to the Rekor transparency log"),
+		rekorURL:    fs.String("rekor-url", "", "URL of the Rekor instance used by --tlog-upload (default the public instance)"),
+		rekorKey:    fs.String("rekor-public-key", "", "path to the public key of the Rekor instance, required with --rekor-url (default the public instance's key)"),
+		attach:      fs.String("attach", "", "push the signed statements to the registry as a cosign .att tag (cosign), OCI 1.1 referrers (referrer), or both (both)"),
+	}
+}
+
+// attestationOptions parses the attestation flags.
+func attestationOptions(mode, format, slsaVersion string, signing signingFlags) pkg.AttestationOptions {
+	m, err := pkg.ParseAttestationMode(mode)
+	check(err)
+	f, err := pkg.ParseAttestationFormat(format)
+	check(err)
+	v, err := pkg.ParseSLSAVersion(slsaVersion)
+	check(err)
+	opts := pkg.AttestationOptions{Mode: m, Format: f, SLSAVersion: v}
+	if *signing.idTokenFile != "" {
+		opts.Tokens = pkg.NewFileTokenProvider(*signing.idTokenFile)
+	} else {
+		opts.Tokens = pkg.NewGitHubTokenProvider()
+	}
+	if *signing.oidcJWKS != "" {
+		opts.TokenVerifier, err = pkg.NewTokenVerifierFromJWKSFile(*signing.oidcIssuer, *signing.oidcJWKS)
+		check(err)
+	} else {
+		opts.TokenVerifier = pkg.NewTokenVerifier(*signing.oidcIssuer)
+	}
+
+	switch {
+	case *signing.key != "" && *signing.keyless:
+		usage(os.Args[0])
+	// The token of the file identifies the builder, so its audience
+	// is the builder's, while Fulcio only accepts its own audience.
+	case *signing.idTokenFile != "" && *signing.keyless:
+		usage(os.Args[0])
+	case *signing.key != "":
+		opts.Signer, err = pkg.LoadSigningKeyFile(*signing.key, []byte(os.Getenv("COSIGN_PASSWORD")))
+		check(err)
+	case *signing.keyless:
+		// The certificate is requested once the images are published.
+		opts.Fulcio = pkg.NewFulcioClient(*signing.fulcioURL)
+	}
+	if *signing.tlogUpload {
+		var rekorKey *ecdsa.PublicKey
+		if *signing.rekorKey != "" {
+			rekorKey, err = pkg.LoadRekorPublicKeyFile(*signing.rekorKey)
+			check(err)
+		}
+		opts.Rekor, err = pkg.NewRekorClient(*signing.rekorURL, rekorKey)
+		check(err)
+	}
+	// Fail before building if the attestations cannot be attached.
+	if *signing.attach != "" {
+		_, err := pkg.ParseAttachmentMode(*signing.attach)
+		check(err)
+		if opts.Signer == nil && opts.Fulcio == nil {
+			usage(os.Args[0])
+		}
+	}
+	return opts
+}
+
+// attachAttestations pushes the attestations to the registry if requested.
+func attachAttestations(attestations []pkg.Attestation, signing signingFlags) {
+	if *signing.attach == "" {
+		return
+	}
+	mode, err := pkg.ParseAttachmentMode(*signing.attach)
+	check(err)
+	err = pkg.AttachAttestations(attestations, mode)
+	check(err)
+}
+
+// writeAttestations writes the attestations to their files and
+// shares the filenames and the subjects of each file.
+func writeAttestations(attestations []pkg.Attestation) {
+	type output struct {
+		Filename    string   `json:"filename"`
+		Subjects    []string `json:"subjects"`
+		Certificate string   `json:"certificate,omitempty"`
+		Bundle      string   `json:"bundle,omitempty"`
+	}
+
+	filenames := make([]string, 0, len(attestations))
+	outputs := make([]output, 0, len(attestations))
+	for _, att := range attestations {
+		err := ioutil.WriteFile(att.Filename, att.Content, 0600)
+		check(err)
+
+		o := output{Filename: att.Filename}
+		base := strings.TrimSuffix(att.Filename, ".intoto.jsonl")
+		if att.Certificate != nil {
+			o.Certificate = base + ".pem"
+			err := ioutil.WriteFile(o.Certificate, att.Certificate, 0600)
+			check(err)
+		}
+		if att.Bundle != nil {
+			bundle, err := json.Marshal(att.Bundle)
+			check(err)
+			o.Bundle = base + ".bundle.json"
+			err = ioutil.WriteFile(o.Bundle, bundle, 0600)
+			check(err)
+		}
+		for _, image := range att.Images {
+			o.Subjects = append(o.Subjects, image.String())
+		}
+		filenames = append(filenames, att.Filename)
+		outputs = append(outputs, o)
+	}
+
+	if len(filenames) == 1 {
+		fmt.Printf("::set-output name=predicate::%s\n", filenames[0])
+	}
+
+	jsonData, err := json.Marshal(filenames)
+	check(err)
+	fmt.Printf("::set-output name=predicates::%s\n", base64.StdEncoding.EncodeToString(jsonData))
+
+	jsonData, err = json.Marshal(outputs)
+	check(err)
+	fmt.Printf("::set-output name=attestations::%s\n", base64.StdEncoding.EncodeToString(jsonData))
+}
+
+// verify checks the attestation file about the image, or
+// the attestations attached to it, and prints the results.
+func verify(image, attestation, certificate, bundle string, opts pkg.VerifyOptions) {
+	var results []pkg.VerificationResult
+	if attestation != "" {
+		img, err := pkg.ParseImage(image)
+		check(err)
+		content, err := ioutil.ReadFile(attestation)
+		check(err)
+		var cert []byte
+		if certificate != "" {
+			cert, err = ioutil.ReadFile(certificate)
+			check(err)
+		}
+		var rekorBundle []byte
+		if bundle != "" {
+			rekorBundle, err = ioutil.ReadFile(bundle)
+			check(err)
+		}
+		res, err := pkg.VerifyAttestation(attestation, content, cert, rekorBundle, *img, opts)
+		check(err)
+		results = append(results, *res)
+	} else {
+		if certificate != "" || bundle != "" {
+			usage(os.Args[0])
+		}
+		var err error
+		results, err = pkg.VerifyImage(image, opts)
+		check(err)
+	}
+
+	jsonData, err := json.MarshalIndent(results, "", "  ")
+	check(err)
+	fmt.Println(string(jsonData))
+
+	// One valid attestation is enough.
+	for _, res := range results {
+		if res.Passed {
+			return
+		}
+	}
+	os.Exit(exitCodeVerificationFailed)
+}
+
 func main() {
 	// Build command.
 	buildCmd := flag.NewFlagSet("build", flag.ExitOnError)
 	buildDry := buildCmd.Bool("dry", false, "dry run of the build without invoking ko")
-	buildEnv := buildCmd.String("envs", "", "env variables for ko")
-	buildArgs := buildCmd.String("args", "", "arguments for ko")
+	buildCapture := buildCmd.Bool("capture", false, "run ko as a child process and output the published images")
+	buildDate := buildCmd.String("date", "", "RFC 3339 time templated ldflags are expanded with, as output by build --dry (default now)")
+	buildEnv := buildCmd.String("envs", "", "comma-separated NAME=VALUE env variables for ko")
+	buildEnvList := buildCmd.String("envs-list", "", "base64-encoded JSON list of NAME=VALUE env variables for ko")
+	buildArgs := buildCmd.String("args", "", "arguments for ko, tokenized with shell quoting rules")
+	buildArgsList := buildCmd.String("args-list", "", "base64-encoded JSON list of arguments for ko")
+
+	// Build and attest command.
+	attestCmd := flag.NewFlagSet("build-and-attest", flag.ExitOnError)
+	attestEnv := attestCmd.String("envs", "", "comma-separated NAME=VALUE env variables for ko")
+	attestEnvList := attestCmd.String("envs-list", "", "base64-encoded JSON list of NAME=VALUE env variables for ko")
+	attestArgs := attestCmd.String("args", "", "arguments for ko, tokenized with shell quoting rules")
+	attestArgsList := attestCmd.String("args-list", "", "base64-encoded JSON list of arguments for ko")
+	attestMode := attestCmd.String("mode", string(pkg.AttestationPerImage), "one attestation per image (per-image), or for all images (combined)")
+	attestFormat := attestCmd.String("format", string(pkg.FormatPredicate), "output the SLSA predicate (predicate), or an in-toto statement (statement)")
+	attestSLSAVersion := attestCmd.String("slsa-version", string(pkg.SLSAVersion02), "version of the SLSA provenance format (0.2 or 1.0)")
+	attestGoModuleDir := attestCmd.String("go-module-dir", "", "directory of the Go module whose go.sum dependencies are recorded as materials")
+	attestBaseImages := attestCmd.String("base-images", "none", "record the base images as materials: none, warn or fail when one is referenced by tag")
+	attestSigning := addSigningFlags(attestCmd)
+
+	// Registry command.
+	registryCmd := flag.NewFlagSet("registry", flag.ExitOnError)
+	registryEnv := registryCmd.String("envs", "", "comma-separated NAME=VALUE env variables for ko")
+	registryEnvList := registryCmd.String("envs-list", "", "base64-encoded JSON list of NAME=VALUE env variables for ko")
 
 	// Predicate command.
 	predicateCmd := flag.NewFlagSet("predicate", flag.ExitOnError)
 	predicateName := predicateCmd.String("artifact-name", "", "untrusted artifact name")
 	predicateDigest := predicateCmd.String("digest", "", "sha256 digest of the artifact")
+	predicateImage := predicateCmd.String("image", "", "image reference by digest, as output by build --capture")
+	predicateImages := predicateCmd.String("images", "", "base64-encoded JSON list of image references by digest, as output by build --capture")
+	predicateMode := predicateCmd.String("mode", string(pkg.AttestationPerImage), "one attestation per image (per-image), or for all images (combined)")
+	predicateFormat := predicateCmd.String("format", string(pkg.FormatPredicate), "output the SLSA predicate (predicate), or an in-toto statement (statement)")
+	predicateSLSAVersion := predicateCmd.String("slsa-version", string(pkg.SLSAVersion02), "version of the SLSA provenance format (0.2 or 1.0)")
+	predicateGoModuleDir := predicateCmd.String("go-module-dir", "", "directory of the Go module whose go.sum dependencies are recorded as materials")
+	predicateBaseImages := predicateCmd.String("base-images", "none", "record the base images as materials: none, warn or fail when one is referenced by tag")
+	predicateSigning := addSigningFlags(predicateCmd)
+	predicateKoConfig := predicateCmd.String("ko-config", "", "base64-encoded ko configuration with its expanded ldflags, as output by build --dry")
+	predicateKoVersion := predicateCmd.String("ko-version", "", "version of ko the images were built with, as output by build --capture")
 	predicateCommand := predicateCmd.String("command", "", "command used to generate the artifact")
 	predicateEnv := predicateCmd.String("env", "", "env variables used to generate the artifact")
 
+	// Verify command.
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	verifyImage := verifyCmd.String("image", "", "image reference, by digest if --attestation is set")
+	verifyAttestation := verifyCmd.String("attestation", "", "path to a DSSE envelope; by default the attestations attached to the image are fetched")
+	verifyCertificate := verifyCmd.String("certificate", "", "path to the certificate chain of a keyless --attestation")
+	verifyBundle := verifyCmd.String("bundle", "", "path to the Rekor bundle of --attestation, required if it is keyless")
+	verifyKey := verifyCmd.String("key", "", "path to the public key that verifies attestations signed with a key")
+	verifyRoots := verifyCmd.String("ca-roots", "", "path to the root certificates that verify keyless attestations")
+	verifyIssuer := verifyCmd.String("certificate-oidc-issuer", "", "expected OIDC issuer of keyless certificates (default the GitHub Actions issuer)")
+	verifyRekorKey := verifyCmd.String("rekor-public-key", "", "path to the public key of the Rekor instance that logged the attestations (default the public instance's key)")
+	verifyBuilderID := verifyCmd.String("builder-id", "", "expected reusable workflow ref of the builder")
+	verifySourceURI := verifyCmd.String("source-uri", "", "expected source repository, e.g., github.com/org/repo")
+	verifySourceRef := verifyCmd.String("source-ref", "", "expected git ref of the source, e.g., refs/tags/v1.2.3")
+
 	// Expect a sub-command.
 	if len(os.Args) < 2 {
 		usage(os.Args[0])
@@ -67,43 +352,154 @@ func main() {
 
 		kobuild := pkg.KoBuildNew(ko)
 
-		// Set arguments.
-		err = kobuild.SetArgs(*buildArgs)
+		setKoArgs(kobuild, *buildArgs, *buildArgsList, *buildEnv, *buildEnvList)
+
+		// Templated ldflags are expanded with the GitHub context, if available.
+		if ghContext, ok := os.LookupEnv("GITHUB_CONTEXT"); ok {
+			check(kobuild.SetGitHubContext(ghContext))
+		}
+		if *buildDate != "" {
+			check(kobuild.SetDate(*buildDate))
+		}
+
+		if *buildDry && *buildCapture {
+			usage(os.Args[0])
+		}
+		if *buildCapture {
+			_, err = kobuild.RunAndCapture()
+		} else {
+			err = kobuild.Run(*buildDry)
+		}
 		check(err)
+	case attestCmd.Name():
+		attestCmd.Parse(os.Args[2:])
 
-		// Set env variables encoded as arguments.
-		err = kobuild.SetArgEnvVariables(*buildEnv)
+		ko, err := exec.LookPath("ko")
 		check(err)
 
-		err = kobuild.Run(*buildDry)
+		kobuild := pkg.KoBuildNew(ko)
+		setKoArgs(kobuild, *attestArgs, *attestArgsList, *attestEnv, *attestEnvList)
+
+		opts := attestationOptions(*attestMode, *attestFormat, *attestSLSAVersion, attestSigning)
+		opts.GoModuleDir = *attestGoModuleDir
+		opts.BaseImages = pkg.BaseImagePolicy(*attestBaseImages)
+		attestations, err := kobuild.BuildAndAttest(getGitHubContext(), opts)
 		check(err)
+
+		writeAttestations(attestations)
+		attachAttestations(attestations, attestSigning)
+
+	case registryCmd.Name():
+		registryCmd.Parse(os.Args[2:])
+
+		// ko is not invoked, so its path is not needed.
+		kobuild := pkg.KoBuildNew("")
+
+		// All the failures exit with the same code, and the
+		// standard output only holds the outputs.
+		invalidRegistry := func(err error) {
+			fmt.Fprintf(os.Stderr, "registry: %v\n", err)
+			os.Exit(exitCodeInvalidRegistry)
+		}
+		if *registryEnv != "" && *registryEnvList != "" {
+			invalidRegistry(errors.New("--envs and --envs-list are mutually exclusive"))
+		}
+		var err error
+		if *registryEnvList != "" {
+			err = kobuild.SetArgEnvVariablesList(*registryEnvList)
+		} else {
+			err = kobuild.SetArgEnvVariables(*registryEnv)
+		}
+		if err != nil {
+			invalidRegistry(err)
+		}
+
+		registry, err := kobuild.Registry()
+		if err != nil {
+			invalidRegistry(err)
+		}
+
+		fmt.Printf("::set-output name=registry::%s\n", registry.Address())
+		fmt.Printf("::set-output name=registry-host::%s\n", registry.Host)
+		fmt.Printf("::set-output name=registry-port::%s\n", registry.Port)
+		fmt.Printf("::set-output name=registry-repository::%s\n", registry.Repository)
+
 	case predicateCmd.Name():
 		predicateCmd.Parse(os.Args[2:])
-		// Note: *predicateEnv may be empty.
-		if *predicateName == "" || *predicateDigest == "" ||
-			*predicateCommand == "" {
+
+		// The images are given by exactly one of name and digest,
+		// reference, or list of references.
+		var images []pkg.Image
+		switch {
+		case *predicateImage != "" && *predicateImages == "" &&
+			*predicateName == "" && *predicateDigest == "":
+			image, err := pkg.ParseImage(*predicateImage)
+			check(err)
+			images = []pkg.Image{*image}
+		case *predicateImages != "" && *predicateImage == "" &&
+			*predicateName == "" && *predicateDigest == "":
+			var err error
+			images, err = pkg.ParseImages(*predicateImages)
+			check(err)
+		case *predicateName != "" && *predicateDigest != "" &&
+			*predicateImage == "" && *predicateImages == "":
+			images = []pkg.Image{{Name: *predicateName, Digest: *predicateDigest}}
+		default:
 			usage(os.Args[0])
 		}
 
-		githubContext, ok := os.LookupEnv("GITHUB_CONTEXT")
-		if !ok {
-			panic(errors.New("environment variable GITHUB_CONTEXT not present"))
+		// Note: *predicateEnv may be empty.
+		if *predicateCommand == "" {
+			usage(os.Args[0])
 		}
 
-		attBytes, err := pkg.GeneratePredicate(*predicateName, *predicateDigest,
-			githubContext, *predicateCommand, *predicateEnv)
+		opts := attestationOptions(*predicateMode, *predicateFormat, *predicateSLSAVersion, predicateSigning)
+		opts.GoModuleDir = *predicateGoModuleDir
+		opts.BaseImages = pkg.BaseImagePolicy(*predicateBaseImages)
+		opts.KoVersion = *predicateKoVersion
+		if *predicateKoConfig != "" {
+			koConfig, err := pkg.ParseKoConfigFile(*predicateKoConfig)
+			check(err)
+			opts.KoConfig = koConfig
+		}
+		attestations, err := pkg.GeneratePredicates(images, getGitHubContext(),
+			*predicateCommand, *predicateEnv, opts)
 		check(err)
 
-		name := strings.Replace(*predicateName, "/", "-", -1)
-		name = strings.Replace(name, ":", "--", -1)
-		filename := fmt.Sprintf("%s.intoto.jsonl", name)
-		err = ioutil.WriteFile(filename, attBytes, 0600)
+		writeAttestations(attestations)
+		attachAttestations(attestations, predicateSigning)
+
+	case verifyCmd.Name():
+		verifyCmd.Parse(os.Args[2:])
+
+		if *verifyImage == "" || *verifyBuilderID == "" || *verifySourceURI == "" {
+			usage(os.Args[0])
+		}
+		opts := pkg.VerifyOptions{
+			BuilderID: *verifyBuilderID,
+			SourceURI: *verifySourceURI,
+			SourceRef: *verifySourceRef,
+			Issuer:    *verifyIssuer,
+		}
+		var err error
+		switch {
+		case *verifyKey != "" && *verifyRoots == "":
+			opts.PublicKey, err = pkg.LoadVerificationKeyFile(*verifyKey)
+		case *verifyRoots != "" && *verifyKey == "":
+			opts.Roots, err = pkg.LoadCertificateRootsFile(*verifyRoots)
+		default:
+			usage(os.Args[0])
+		}
 		check(err)
+		if *verifyRekorKey != "" {
+			opts.RekorPublicKey, err = pkg.LoadRekorPublicKeyFile(*verifyRekorKey)
+			check(err)
+		}
 
-		fmt.Printf("::set-output name=predicate::%s\n", filename)
+		verify(*verifyImage, *verifyAttestation, *verifyCertificate, *verifyBundle, opts)
 
 	default:
-		fmt.Println("expected 'build' or 'predicate' subcommands")
+		fmt.Println("expected 'build', 'build-and-attest', 'registry', 'predicate' or 'verify' subcommands")
 		os.Exit(1)
 	}
 }
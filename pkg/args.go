@@ -0,0 +1,111 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errorInvalidArgument = errors.New("invalid argument")
+
+// splitArgs tokenizes a command line the way a POSIX shell would,
+// without performing any expansion: words are separated by unquoted
+// whitespace, single quotes preserve their content literally, double
+// quotes honor the \$, \`, \", \\ and \<newline> escapes, and an
+// unquoted backslash escapes the following character.
+// Spec: https://pubs.opengroup.org/onlinepubs/9699919799/utilities/V3_chap02.html#tag_02_02.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		// inWord is true when a word has been started, even if
+		// it is empty, e.g. `""`.
+		inWord bool
+	)
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+				inWord = false
+			}
+
+		case c == '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("%w: trailing backslash: %s", errorInvalidArgument, s)
+			}
+			i++
+			// A backslash-newline is a line continuation.
+			if runes[i] == '\n' {
+				continue
+			}
+			current.WriteRune(runes[i])
+			inWord = true
+
+		case c == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated single quote: %s", errorInvalidArgument, s)
+			}
+			current.WriteString(string(runes[i+1 : end]))
+			i = end
+			inWord = true
+
+		case c == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					switch runes[i+1] {
+					case '$', '`', '"', '\\':
+						i++
+					case '\n':
+						i++
+						continue
+					}
+				}
+				current.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("%w: unterminated double quote: %s", errorInvalidArgument, s)
+			}
+			inWord = true
+
+		default:
+			current.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+func indexRune(runes []rune, start int, r rune) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,173 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_splitArgs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		args     string
+		expected []string
+		err      error
+	}{
+		{
+			name:     "simple args",
+			args:     "--bare --tags=latest",
+			expected: []string{"--bare", "--tags=latest"},
+		},
+		{
+			name:     "repeated whitespace",
+			args:     "  --bare \t  --tags=latest\n",
+			expected: []string{"--bare", "--tags=latest"},
+		},
+		{
+			name:     "empty",
+			args:     "   ",
+			expected: nil,
+		},
+		{
+			name:     "double quotes",
+			args:     `--tags="a b" ./cmd`,
+			expected: []string{"--tags=a b", "./cmd"},
+		},
+		{
+			name:     "single quotes",
+			args:     `'-ldflags=-X main.version=v1.2.3 -s' ./cmd`,
+			expected: []string{"-ldflags=-X main.version=v1.2.3 -s", "./cmd"},
+		},
+		{
+			name:     "single quotes are literal",
+			args:     `'a\"b $HOME'`,
+			expected: []string{`a\"b $HOME`},
+		},
+		{
+			name:     "double quotes escapes",
+			args:     `"a\"b \$HOME \\ \n"`,
+			expected: []string{`a"b $HOME \ \n`},
+		},
+		{
+			name:     "backslash outside quotes",
+			args:     `a\ b c\\d`,
+			expected: []string{"a b", `c\d`},
+		},
+		{
+			name:     "line continuation",
+			args:     "--bare \\\n./cmd",
+			expected: []string{"--bare", "./cmd"},
+		},
+		{
+			name:     "empty quoted arg",
+			args:     `--tags "" ''`,
+			expected: []string{"--tags", "", ""},
+		},
+		{
+			name:     "mixed quotes in one word",
+			args:     `--tags='a b'"c d"e`,
+			expected: []string{"--tags=a bc de"},
+		},
+		{
+			name: "unterminated double quote",
+			args: `--tags="a b`,
+			err:  errorInvalidArgument,
+		},
+		{
+			name: "unterminated single quote",
+			args: `--tags='a b`,
+			err:  errorInvalidArgument,
+		},
+		{
+			name: "trailing backslash",
+			args: `--tags=a\`,
+			err:  errorInvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			args, err := splitArgs(tt.args)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(args, tt.expected) {
+				t.Errorf(cmp.Diff(args, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_SetArgsList(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "args with spaces",
+			args:     []string{"--tags=a b", "--image-label=title=my app", "./cmd/app"},
+			expected: []string{"--tags=a b", "--image-label=title=my app", "./cmd/app"},
+		},
+		{
+			name:     "empty list",
+			args:     []string{},
+			expected: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			encoded, err := marshallList(tt.args)
+			if err != nil {
+				t.Fatalf("marshallList: %v", err)
+			}
+
+			b := KoBuildNew("ko")
+			if err := b.SetArgsList(encoded); err != nil {
+				t.Fatalf("SetArgsList: %v", err)
+			}
+
+			cmd, err := b.generateCommandArgs()
+			if err != nil {
+				t.Fatalf("generateCommandArgs: %v", err)
+			}
+			expectedCmd := append([]string{"ko", "publish"}, tt.expected...)
+			if !cmp.Equal(cmd, expectedCmd) {
+				t.Errorf(cmp.Diff(cmd, expectedCmd))
+			}
+		})
+	}
+
+	b := KoBuildNew("ko")
+	if err := b.SetArgsList("not base64!"); !errCmp(err, errorInvalidArgument) {
+		t.Errorf(cmp.Diff(err, errorInvalidArgument))
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	intoto "github.com/in-toto/in-toto-golang/in_toto"
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+)
+
+var (
+	errorInvalidAttachmentMode = errors.New("invalid attachment mode")
+	errorAttachFailed          = errors.New("attaching the attestation failed")
+)
+
+// AttachmentMode selects how attestations are attached to the images.
+type AttachmentMode string
+
+const (
+	// AttachCosign pushes the attestations to the `sha256-<hex>.att`
+	// tag, as `cosign attest` does.
+	AttachCosign AttachmentMode = "cosign"
+	// AttachReferrer pushes the attestations as OCI 1.1 artifacts
+	// whose subject is the image.
+	AttachReferrer AttachmentMode = "referrer"
+	// AttachBoth does both.
+	AttachBoth AttachmentMode = "both"
+)
+
+// ParseAttachmentMode parses the name of an attachment mode.
+func ParseAttachmentMode(mode string) (AttachmentMode, error) {
+	switch AttachmentMode(mode) {
+	case AttachCosign, AttachReferrer, AttachBoth:
+		return AttachmentMode(mode), nil
+	default:
+		return "", fmt.Errorf("%w: %s", errorInvalidAttachmentMode, mode)
+	}
+}
+
+// Media types and annotations of attached attestations.
+const (
+	dsseEnvelopeMediaType = "application/vnd.dsse.envelope.v1+json"
+	// See https://github.com/opencontainers/image-spec/blob/v1.1.0/manifest.md#guidance-for-an-empty-descriptor.
+	ociEmptyMediaType = "application/vnd.oci.empty.v1+json"
+
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+	predicateTypeAnnotation     = "predicateType"
+)
+
+// AttachAttestations pushes the signed attestations next to each
+// of their subjects, with the credentials of the Docker configuration.
+func AttachAttestations(attestations []Attestation, mode AttachmentMode) error {
+	return attachAttestations(attestations, mode,
+		remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+func attachAttestations(attestations []Attestation, mode AttachmentMode,
+	opts ...remote.Option) error {
+	if _, err := ParseAttachmentMode(string(mode)); err != nil {
+		return err
+	}
+
+	for _, att := range attestations {
+		annotations, err := attachmentAnnotations(att)
+		if err != nil {
+			return err
+		}
+
+		for _, image := range att.Images {
+			ref, err := name.NewDigest(image.String())
+			if err != nil {
+				return fmt.Errorf("%w: %v", errorInvalidImage, err)
+			}
+
+			if mode == AttachCosign || mode == AttachBoth {
+				if err := attachCosign(ref, att.Content, annotations, opts...); err != nil {
+					return fmt.Errorf("%w: %s: %v", errorAttachFailed, image, err)
+				}
+			}
+			if mode == AttachReferrer || mode == AttachBoth {
+				if err := attachReferrer(ref, att.Content, annotations, opts...); err != nil {
+					return fmt.Errorf("%w: %s: %v", errorAttachFailed, image, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// attachmentAnnotations returns the cosign annotations of the layer
+// holding the attestation, which must be a DSSE envelope.
+func attachmentAnnotations(att Attestation) (map[string]string, error) {
+	var envelope dsse.Envelope
+	if err := json.Unmarshal(att.Content, &envelope); err != nil ||
+		envelope.PayloadType != intoto.PayloadType {
+		return nil, fmt.Errorf("%w: %s: only signed statements can be attached",
+			errorInvalidAttestationFormat, att.Filename)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errorInvalidAttestationFormat, att.Filename, err)
+	}
+	var header intoto.StatementHeader
+	if err := json.Unmarshal(payload, &header); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errorInvalidAttestationFormat, att.Filename, err)
+	}
+
+	annotations := map[string]string{
+		// Attestations are signed by their envelope.
+		cosignSignatureAnnotation: "",
+		predicateTypeAnnotation:   header.PredicateType,
+	}
+
+	if att.Certificate != nil {
+		certs, err := cryptoutils.UnmarshalCertificatesFromPEM(att.Certificate)
+		if err != nil || len(certs) == 0 {
+			return nil, fmt.Errorf("%w: %s: invalid certificate: %v", errorAttachFailed, att.Filename, err)
+		}
+		leaf, err := cryptoutils.MarshalCertificateToPEM(certs[0])
+		if err != nil {
+			return nil, err
+		}
+		chain, err := cryptoutils.MarshalCertificatesToPEM(certs[1:])
+		if err != nil {
+			return nil, err
+		}
+		annotations[cosignCertificateAnnotation] = string(leaf)
+		annotations[cosignChainAnnotation] = string(chain)
+	}
+
+	if att.Bundle != nil {
+		bundle, err := json.Marshal(att.Bundle)
+		if err != nil {
+			return nil, err
+		}
+		annotations[cosignBundleAnnotation] = string(bundle)
+	}
+
+	return annotations, nil
+}
+
+// attachCosign appends the envelope to the image of the `.att` tag,
+// unless it is already there.
+func attachCosign(ref name.Digest, envelope []byte, annotations map[string]string,
+	opts ...remote.Option) error {
+	tag := ref.Context().Tag(strings.Replace(ref.DigestStr(), ":", "-", 1) + ".att")
+
+	base, err := remote.Image(tag, opts...)
+	if isNotFound(err) {
+		base = empty.Image
+	} else if err != nil {
+		return err
+	}
+
+	layer := static.NewLayer(envelope, dsseEnvelopeMediaType)
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	layers, err := base.Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		if d, err := l.Digest(); err == nil && d == digest {
+			return nil
+		}
+	}
+
+	img, err := mutate.Append(base, mutate.Addendum{
+		Layer:       layer,
+		Annotations: annotations,
+	})
+	if err != nil {
+		return err
+	}
+	return remote.Write(tag, img, opts...)
+}
+
+// ociDescriptor is a descriptor with the fields added in OCI 1.1,
+// which v1.Descriptor does not have.
+type ociDescriptor struct {
+	MediaType    types.MediaType   `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       v1.Hash           `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// ociArtifactManifest is an OCI 1.1 image manifest of an artifact.
+type ociArtifactManifest struct {
+	SchemaVersion int64             `json:"schemaVersion"`
+	MediaType     types.MediaType   `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Subject       *ociDescriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociIndex is an OCI image index of referrers.
+type ociIndex struct {
+	SchemaVersion int64           `json:"schemaVersion"`
+	MediaType     types.MediaType `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// rawManifest is a manifest pushed as-is.
+type rawManifest struct {
+	manifest  []byte
+	mediaType types.MediaType
+}
+
+func (m rawManifest) RawManifest() ([]byte, error)        { return m.manifest, nil }
+func (m rawManifest) MediaType() (types.MediaType, error) { return m.mediaType, nil }
+
+// attachReferrer pushes the envelope as an artifact whose subject is
+// the image. Registries without the referrers API find it through the
+// `sha256-<hex>` tag, as the OCI 1.1 distribution spec's fallback.
+// See https://github.com/opencontainers/distribution-spec/blob/v1.1.0/spec.md#referrers-tag-schema.
+func attachReferrer(ref name.Digest, envelope []byte, annotations map[string]string,
+	opts ...remote.Option) error {
+	subject, err := remote.Head(ref, opts...)
+	if err != nil {
+		return err
+	}
+
+	layer := static.NewLayer(envelope, dsseEnvelopeMediaType)
+	config := static.NewLayer([]byte("{}"), ociEmptyMediaType)
+	for _, l := range []v1.Layer{layer, config} {
+		if err := remote.WriteLayer(ref.Context(), l, opts...); err != nil {
+			return err
+		}
+	}
+	layerDesc, err := layerDescriptor(layer, annotations)
+	if err != nil {
+		return err
+	}
+	configDesc, err := layerDescriptor(config, nil)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(ociArtifactManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  intoto.PayloadType,
+		Config:        *configDesc,
+		Layers:        []ociDescriptor{*layerDesc},
+		Subject: &ociDescriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+		Annotations: map[string]string{
+			predicateTypeAnnotation: annotations[predicateTypeAnnotation],
+		},
+	})
+	if err != nil {
+		return err
+	}
+	digest, size, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	if err := remote.Put(ref.Context().Digest(digest.String()),
+		rawManifest{manifest: manifest, mediaType: types.OCIManifestSchema1}, opts...); err != nil {
+		return err
+	}
+
+	// Add the artifact to the fallback index, unless it is already there.
+	tag := ref.Context().Tag(strings.Replace(ref.DigestStr(), ":", "-", 1))
+	index := ociIndex{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	existing, err := remote.Get(tag, opts...)
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(existing.Manifest, &index); err != nil {
+			return err
+		}
+	}
+	for _, m := range index.Manifests {
+		if m.Digest == digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, ociDescriptor{
+		MediaType:    types.OCIManifestSchema1,
+		ArtifactType: intoto.PayloadType,
+		Digest:       digest,
+		Size:         size,
+		Annotations: map[string]string{
+			predicateTypeAnnotation: annotations[predicateTypeAnnotation],
+		},
+	})
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return remote.Put(tag, rawManifest{manifest: content, mediaType: types.OCIImageIndex}, opts...)
+}
+
+func layerDescriptor(l v1.Layer, annotations map[string]string) (*ociDescriptor, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return nil, err
+	}
+	mt, err := l.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	return &ociDescriptor{MediaType: mt, Digest: digest, Size: size, Annotations: annotations}, nil
+}
+
+// isNotFound returns whether the registry has no such manifest.
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == 404
+}
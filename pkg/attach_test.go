@@ -0,0 +1,299 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// newTestRegistry starts an in-memory registry and returns its host.
+func newTestRegistry(t *testing.T) string {
+	t.Helper()
+
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	t.Cleanup(s.Close)
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// testRegistryTransport sends the requests to any registry
+// to the test registry at host.
+type testRegistryTransport string
+
+func (host testRegistryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = "http"
+	r.URL.Host = string(host)
+	r.Host = string(host)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// withTestRegistry serves the images of any registry, e.g., ghcr.io,
+// from the test registry at host.
+func withTestRegistry(host string) remote.Option {
+	return remote.WithTransport(testRegistryTransport(host))
+}
+
+// pushRandomImage pushes a random image to the repository.
+func pushRandomImage(t *testing.T, repository string) Image {
+	t.Helper()
+
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	ref, err := name.ParseReference(repository + ":latest")
+	if err != nil {
+		t.Fatalf("name.ParseReference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("remote.Write: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	return Image{Name: repository, Digest: digest.Hex}
+}
+
+func Test_attachAttestations(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	keyless, err := NewKeylessSigner(newFakeFulcio(t), testJWT(t, map[string]string{
+		"sub":              "repo:org/repo:ref:refs/tags/v1.2.3",
+		"job_workflow_ref": testJobWorkflowRef,
+	}))
+	if err != nil {
+		t.Fatalf("NewKeylessSigner: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		mode        AttachmentMode
+		opts        AttestationOptions
+		att         bool
+		referrer    bool
+		annotations []string
+		err         error
+	}{
+		{
+			name:        "cosign",
+			mode:        AttachCosign,
+			opts:        AttestationOptions{Format: FormatStatement, Signer: newTestSigner(t)},
+			att:         true,
+			annotations: []string{cosignSignatureAnnotation, predicateTypeAnnotation},
+		},
+		{
+			name:     "referrer",
+			mode:     AttachReferrer,
+			opts:     AttestationOptions{Format: FormatStatement, Signer: newTestSigner(t)},
+			referrer: true,
+		},
+		{
+			name: "both keyless with bundle",
+			mode: AttachBoth,
+			opts: AttestationOptions{
+				Format: FormatStatement,
+				Signer: keyless,
+				Rekor:  newFakeRekor(t),
+			},
+			att:      true,
+			referrer: true,
+			annotations: []string{
+				cosignSignatureAnnotation, predicateTypeAnnotation, cosignCertificateAnnotation,
+				cosignChainAnnotation, cosignBundleAnnotation,
+			},
+		},
+		{
+			name: "unsigned",
+			mode: AttachBoth,
+			opts: AttestationOptions{Format: FormatStatement},
+			err:  errorInvalidAttestationFormat,
+		},
+		{
+			name: "invalid mode",
+			mode: "tag",
+			opts: AttestationOptions{Format: FormatStatement, Signer: newTestSigner(t)},
+			err:  errorInvalidAttachmentMode,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			host := newTestRegistry(t)
+			images := []Image{
+				pushRandomImage(t, host+"/org/a"),
+				pushRandomImage(t, host+"/org/b"),
+			}
+
+			opts, err := tt.opts.normalize()
+			if err != nil {
+				t.Fatalf("normalize: %v", err)
+			}
+			opts.Mode = AttestationCombined
+			attestations, err := generateAttestations(images, gh, []string{"ko", "publish"}, nil, testBuilder, opts)
+			if err != nil {
+				t.Fatalf("generateAttestations: %v", err)
+			}
+
+			// Attaching twice does not duplicate the attestations.
+			for i := 0; i < 2; i++ {
+				err = attachAttestations(attestations, tt.mode)
+				if !errCmp(err, tt.err) {
+					t.Fatalf(cmp.Diff(err, tt.err))
+				}
+			}
+			if err != nil {
+				return
+			}
+
+			for _, image := range images {
+				ref, err := name.NewDigest(image.String())
+				if err != nil {
+					t.Fatalf("name.NewDigest: %v", err)
+				}
+				checkCosignAttachment(t, ref, tt.att, attestations[0].Content, tt.annotations)
+				checkReferrerAttachment(t, ref, tt.referrer, attestations[0].Content)
+			}
+		})
+	}
+}
+
+func checkCosignAttachment(t *testing.T, ref name.Digest, expected bool,
+	envelope []byte, annotations []string) {
+	t.Helper()
+
+	tag := ref.Context().Tag("sha256-" + ref.DigestStr()[len("sha256:"):] + ".att")
+	img, err := remote.Image(tag)
+	if !expected {
+		if !isNotFound(err) {
+			t.Errorf("%s: unexpected attestation: %v", tag, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("remote.Image: %v", err)
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("%s: expected one layer, got %d", tag, len(manifest.Layers))
+	}
+	if manifest.Layers[0].MediaType != dsseEnvelopeMediaType {
+		t.Errorf(cmp.Diff(manifest.Layers[0].MediaType, dsseEnvelopeMediaType))
+	}
+	for _, a := range annotations {
+		if _, ok := manifest.Layers[0].Annotations[a]; !ok {
+			t.Errorf("%s: missing annotation %s", tag, a)
+		}
+	}
+	if manifest.Layers[0].Annotations[predicateTypeAnnotation] != "https://slsa.dev/provenance/v0.2" {
+		t.Errorf("%s: unexpected predicate type: %s", tag, manifest.Layers[0].Annotations[predicateTypeAnnotation])
+	}
+
+	layer, err := img.LayerByDigest(manifest.Layers[0].Digest)
+	if err != nil {
+		t.Fatalf("LayerByDigest: %v", err)
+	}
+	content := readLayer(t, layer.Compressed)
+	if string(content) != string(envelope) {
+		t.Errorf(cmp.Diff(string(content), string(envelope)))
+	}
+}
+
+func checkReferrerAttachment(t *testing.T, ref name.Digest, expected bool, envelope []byte) {
+	t.Helper()
+
+	tag := ref.Context().Tag("sha256-" + ref.DigestStr()[len("sha256:"):])
+	desc, err := remote.Get(tag)
+	if !expected {
+		if !isNotFound(err) {
+			t.Errorf("%s: unexpected referrers: %v", tag, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("remote.Get: %v", err)
+	}
+
+	var index ociIndex
+	if err := json.Unmarshal(desc.Manifest, &index); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("%s: expected one referrer, got %d", tag, len(index.Manifests))
+	}
+
+	artifact, err := remote.Get(ref.Context().Digest(index.Manifests[0].Digest.String()))
+	if err != nil {
+		t.Fatalf("remote.Get: %v", err)
+	}
+	var manifest ociArtifactManifest
+	if err := json.Unmarshal(artifact.Manifest, &manifest); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest.String() != ref.DigestStr() {
+		t.Errorf("%s: unexpected subject: %+v", tag, manifest.Subject)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("%s: expected one layer, got %d", tag, len(manifest.Layers))
+	}
+
+	layer, err := remote.Layer(ref.Context().Digest(manifest.Layers[0].Digest.String()))
+	if err != nil {
+		t.Fatalf("remote.Layer: %v", err)
+	}
+	content := readLayer(t, layer.Compressed)
+	if string(content) != string(envelope) {
+		t.Errorf(cmp.Diff(string(content), string(envelope)))
+	}
+}
+
+func readLayer(t *testing.T, open func() (io.ReadCloser, error)) []byte {
+	t.Helper()
+
+	rc, err := open()
+	if err != nil {
+		t.Fatalf("open layer: %v", err)
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("io.ReadAll: %v", err)
+	}
+	return content
+}
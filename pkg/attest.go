@@ -0,0 +1,463 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+var errorInvalidAttestationMode = errors.New("invalid attestation mode")
+
+// AttestationMode selects how the provenance of several images is grouped.
+type AttestationMode string
+
+const (
+	// AttestationPerImage generates one attestation per image.
+	AttestationPerImage AttestationMode = "per-image"
+	// AttestationCombined generates a single attestation whose
+	// subjects are all the images.
+	AttestationCombined AttestationMode = "combined"
+)
+
+// ParseAttestationMode parses the name of an attestation mode.
+// An empty name selects AttestationPerImage.
+func ParseAttestationMode(mode string) (AttestationMode, error) {
+	switch AttestationMode(mode) {
+	case "", AttestationPerImage:
+		return AttestationPerImage, nil
+	case AttestationCombined:
+		return AttestationCombined, nil
+	default:
+		return "", fmt.Errorf("%w: %s", errorInvalidAttestationMode, mode)
+	}
+}
+
+// AttestationOptions configures how attestations are generated.
+type AttestationOptions struct {
+	Mode        AttestationMode
+	Format      AttestationFormat
+	SLSAVersion SLSAVersion
+	// Signer, if set, signs the statements, which are then
+	// wrapped in DSSE envelopes. It requires FormatStatement.
+	Signer signature.Signer
+	// Fulcio, if set instead of Signer, certifies an ephemeral key
+	// that signs the statements for the identity of the token of
+	// Tokens. Since the certificate is short-lived, it is requested
+	// once the images are published.
+	Fulcio FulcioClient
+	// Rekor, if set, records the envelopes in a transparency log.
+	// It requires a Signer or Fulcio.
+	Rekor RekorClient
+	// Tokens issues the OIDC token the builder ID is read from.
+	// It defaults to the GitHub Actions runtime.
+	Tokens TokenProvider
+	// TokenVerifier checks the tokens of Tokens.
+	// It defaults to a verifier of GitHub Actions' tokens.
+	TokenVerifier *TokenVerifier
+	// KoVersion is the version of ko the images were built with, as
+	// output by the build command, which is recorded in the provenance
+	// of GeneratePredicates. It is not recorded if empty.
+	KoVersion string
+	// GoModuleDir is the directory of the Go module the images are
+	// built from, whose dependencies in go.sum are recorded as
+	// materials. They are not recorded if empty. The ko configuration
+	// file is read from GoModuleDir, or from the working directory
+	// if empty.
+	GoModuleDir string
+	// BaseImages selects whether the base images of the built import
+	// paths are recorded as materials, and whether a base image
+	// referenced by tag is an error. The provenance of each image
+	// records the base images of all the import paths, since ko's
+	// output does not tell which one an image is built from. ko's
+	// default base image depends on its version, which must be known
+	// if no base image is configured.
+	BaseImages BaseImagePolicy
+
+	// KoConfig is the ko configuration the images were built with,
+	// with its expanded ldflags, as output by the dry run. It is read
+	// from the repository if nil, without the values of its templated
+	// ldflags.
+	KoConfig *KoConfigFile
+}
+
+func (o AttestationOptions) normalize() (AttestationOptions, error) {
+	mode, err := ParseAttestationMode(string(o.Mode))
+	if err != nil {
+		return o, err
+	}
+	format, err := ParseAttestationFormat(string(o.Format))
+	if err != nil {
+		return o, err
+	}
+	version, err := ParseSLSAVersion(string(o.SLSAVersion))
+	if err != nil {
+		return o, err
+	}
+	signed := o.Signer != nil || o.Fulcio != nil
+	if o.Signer != nil && o.Fulcio != nil {
+		return o, fmt.Errorf("%w: a key and Fulcio are mutually exclusive", errorSigningFailed)
+	}
+	if signed && format != FormatStatement {
+		return o, fmt.Errorf("%w: signing requires the %s format", errorInvalidAttestationFormat, FormatStatement)
+	}
+	if o.Rekor != nil && !signed {
+		return o, fmt.Errorf("%w: only signed attestations can be uploaded", errorRekorFailed)
+	}
+	if o.KoVersion != "" {
+		if err := validateKoVersion(o.KoVersion); err != nil {
+			return o, err
+		}
+	}
+	baseImages, err := ParseBaseImagePolicy(string(o.BaseImages))
+	if err != nil {
+		return o, err
+	}
+	tokens := o.Tokens
+	if tokens == nil {
+		tokens = NewGitHubTokenProvider()
+	}
+	verifier := o.TokenVerifier
+	if verifier == nil {
+		verifier = NewTokenVerifier("")
+	}
+	return AttestationOptions{
+		Mode:          mode,
+		Format:        format,
+		SLSAVersion:   version,
+		Signer:        o.Signer,
+		Fulcio:        o.Fulcio,
+		Rekor:         o.Rekor,
+		Tokens:        tokens,
+		TokenVerifier: verifier,
+		KoVersion:     o.KoVersion,
+		KoConfig:      o.KoConfig,
+		GoModuleDir:   o.GoModuleDir,
+		BaseImages:    baseImages,
+	}, nil
+}
+
+// Attestation is the provenance of one or more published images.
+type Attestation struct {
+	// Images are the subjects of the attestation.
+	Images []Image
+	// Content is the provenance predicate or statement,
+	// depending on the format, or the DSSE envelope of the
+	// statement if signed.
+	Content []byte
+	// Filename is the name of the file the attestation is written to.
+	// It is unique among the attestations generated together.
+	Filename string
+	// Certificate is the PEM-encoded certificate chain of the
+	// signing key, if the attestation is signed keyless.
+	Certificate []byte
+	// Bundle is the proof of inclusion of the attestation
+	// in the transparency log, if uploaded.
+	Bundle *RekorBundle
+}
+
+// unsafeFilenameRegex matches the characters not allowed in filenames.
+var unsafeFilenameRegex = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// maxFilenameLength leaves room for suffixes under the usual
+// 255-byte limit of file systems.
+const maxFilenameLength = 200
+
+// PredicateFilename returns the name of the file the predicate
+// of an artifact is written to. The name is safe to use as
+// a filename: it contains no path separator and does not start
+// with a dot or a dash.
+func PredicateFilename(name string) string {
+	return sanitizeFilename(name) + ".intoto.jsonl"
+}
+
+func sanitizeFilename(name string) string {
+	name = strings.Replace(name, "/", "-", -1)
+	name = strings.Replace(name, ":", "--", -1)
+	name = unsafeFilenameRegex.ReplaceAllString(name, "_")
+	name = strings.TrimLeft(name, ".-")
+	if len(name) > maxFilenameLength {
+		name = name[:maxFilenameLength]
+	}
+	if name == "" {
+		name = "attestation"
+	}
+	return name
+}
+
+// GeneratePredicates generates the provenance of several images
+// built by the same invocation, grouped and formatted according
+// to the options. The manifests of the images are read from the
+// registry if the command builds for several platforms, see
+// resolvePlatformManifests.
+func GeneratePredicates(images []Image, ghContext, command, envs string,
+	opts AttestationOptions) ([]Attestation, error) {
+	return generatePredicates(images, ghContext, command, envs, opts,
+		remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+func generatePredicates(images []Image, ghContext, command, envs string,
+	opts AttestationOptions, remoteOpts ...remote.Option) ([]Attestation, error) {
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	gh, err := parseGitHubContext(ghContext)
+	if err != nil {
+		return nil, err
+	}
+
+	com, err := unmarshallList(command)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := unmarshallList(envs)
+	if err != nil {
+		return nil, err
+	}
+
+	builderID, err := getReusableWorkflowID(opts.Tokens, opts.TokenVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	builder, err := newBuilderInfo(builderID, "")
+	if err != nil {
+		return nil, err
+	}
+	builder.KoVersion = opts.KoVersion
+
+	images, err = resolvePlatformManifests(images, com, env, remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return generateAttestations(images, gh, com, env, builder, opts)
+}
+
+func generateAttestations(images []Image, gh *gitHubContext,
+	com, env []string, builder BuilderInfo, opts AttestationOptions) ([]Attestation, error) {
+	if len(images) == 0 {
+		return nil, errorNoImage
+	}
+
+	// The manifests of multi-platform images, as resolved by
+	// resolveManifests, are subjects too.
+	var inputs buildInputs
+	platforms, err := requestedPlatforms(com)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups [][]Image
+	switch opts.Mode {
+	case AttestationPerImage:
+		for _, image := range images {
+			groups = append(groups, []Image{image})
+		}
+	case AttestationCombined:
+		groups = [][]Image{images}
+	default:
+		return nil, fmt.Errorf("%w: %s", errorInvalidAttestationMode, opts.Mode)
+	}
+
+	if opts.GoModuleDir != "" {
+		modules, err := readGoModules(opts.GoModuleDir)
+		if err != nil {
+			return nil, err
+		}
+		inputs.modules = modules
+	}
+
+	dir := opts.GoModuleDir
+	if dir == "" {
+		dir = "."
+	}
+	koConfig := opts.KoConfig
+	if koConfig == nil {
+		koConfig, err = loadKoConfig(dir, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+	inputs.koConfig = koConfig
+
+	if opts.BaseImages != BaseImageNone {
+		var config *KoConfig
+		if koConfig != nil {
+			config = &koConfig.Config
+		}
+		images, err := resolveBaseImages(dir, config, com, env, builder.KoVersion, opts.BaseImages,
+			remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		if err != nil {
+			return nil, err
+		}
+		inputs.baseImages = images
+	}
+
+	if opts.Fulcio != nil {
+		opts.Signer, err = NewGitHubKeylessSigner(opts.Fulcio, opts.Tokens)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	attestations := make([]Attestation, 0, len(groups))
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, image := range group {
+			if err := validateDigest(image.Digest); err != nil {
+				return nil, err
+			}
+		}
+
+		// The platforms are those of the group's images, while the
+		// other inputs are those of the invocation.
+		groupInputs := inputs
+		groupInputs.platforms = builtPlatforms(group, platforms)
+		p, err := generateProvenance(gh, com, env, builder, groupInputs, opts.SLSAVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := marshallAttestation(group, p, opts.Format)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			certificate []byte
+			bundle      *RekorBundle
+		)
+		if opts.Signer != nil {
+			content, err = SignStatement(content, opts.Signer)
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := opts.Signer.(*KeylessSigner); ok {
+				certificate = s.CertificateChain()
+			}
+		}
+		if opts.Rekor != nil {
+			bundle, err = uploadEnvelope(opts.Rekor, content, opts.Signer)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		filename := attestationFilename(group, seen)
+		seen[filename] = true
+
+		attestations = append(attestations, Attestation{
+			Images:      group,
+			Content:     content,
+			Filename:    filename,
+			Certificate: certificate,
+			Bundle:      bundle,
+		})
+	}
+
+	return attestations, nil
+}
+
+// attestationFilename returns a filename for the images
+// that is not in use yet.
+func attestationFilename(images []Image, used map[string]bool) string {
+	base := sanitizeFilename(images[0].Name)
+	if len(images) > 1 {
+		base = fmt.Sprintf("%s-%d-images", base, len(images))
+	}
+
+	filename := base + ".intoto.jsonl"
+	if !used[filename] {
+		return filename
+	}
+
+	// The same name was published with different digests.
+	base = fmt.Sprintf("%s-%s", base, images[0].Digest[:12])
+	filename = base + ".intoto.jsonl"
+	for i := 2; used[filename]; i++ {
+		filename = fmt.Sprintf("%s-%d.intoto.jsonl", base, i)
+	}
+	return filename
+}
+
+// BuildAndAttest runs ko and generates the provenance of the
+// published images in the same process, grouped and formatted
+// according to the options. The command and env variables recorded
+// in the provenance are those used to run ko.
+func (b *KoBuild) BuildAndAttest(ghContext string, opts AttestationOptions) ([]Attestation, error) {
+	return b.buildAndAttest(ghContext, opts, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+func (b *KoBuild) buildAndAttest(ghContext string, opts AttestationOptions,
+	remoteOpts ...remote.Option) ([]Attestation, error) {
+	// Fail early, before the images are pushed.
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	gh, err := parseGitHubContext(ghContext)
+	if err != nil {
+		return nil, err
+	}
+	b.gh = gh
+
+	builderID, err := getReusableWorkflowID(opts.Tokens, opts.TokenVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	builder, err := newBuilderInfo(builderID, b.ko)
+	if err != nil {
+		return nil, err
+	}
+
+	command, err := b.generateCommandArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := b.generateCommandEnvVariables()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := b.koConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := b.runAndCapture(command, config)
+	if err != nil {
+		return nil, err
+	}
+	images, err = resolvePlatformManifests(images, command, env, remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.KoConfig = config
+	return generateAttestations(images, gh, command, env, builder, opts)
+}
@@ -0,0 +1,508 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	slsa "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v0.2"
+)
+
+const testGitHubContext = `{
+	"repository": "org/repo",
+	"workflow": "release",
+	"workflow_ref": "org/repo/.github/workflows/release.yml@refs/tags/v1.2.3",
+	"event_name": "push",
+	"sha": "b54fb2ec8807e9e4b1e8c0f6b2a9e1a8d7c6b5a4",
+	"ref_type": "tag",
+	"ref": "refs/tags/v1.2.3",
+	"actor": "someone",
+	"run_number": "12",
+	"server_url": "https://github.com",
+	"run_id": "1234567890",
+	"run_attempt": "1",
+	"token": "secret"
+}`
+
+const testJobWorkflowRef = "org/builder/.github/workflows/builder.yml@refs/tags/v1.0.0"
+
+const testKoVersion = "0.11.2"
+
+// testBuilder is the release of the builder in the provenance of tests.
+var testBuilder = BuilderInfo{
+	ID:         testJobWorkflowRef,
+	Digest:     "5f0c3a4be3d9a0e3d2e9c1b7a6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7",
+	KoVersion:  testKoVersion,
+	RunnerOS:   "Linux",
+	RunnerArch: "X64",
+}
+
+func Test_BuildAndAttest(t *testing.T) {
+	t.Parallel()
+
+	issuer := newTestIssuer(t)
+	host := newTestRegistry(t)
+	imageA := pushRandomImage(t, host+"/org/a")
+	imageB := pushRandomImage(t, host+"/org/b")
+	output := "ghcr.io/org/a@sha256:" + imageA.Digest + "\nghcr.io/org/b@sha256:" + imageB.Digest + "\n"
+	b := KoBuildNew(writeFakeKo(t, output, 0))
+	if err := b.SetArgEnvVariables("KO_DOCKER_REPO=ghcr.io/org,GOFLAGS=-trimpath"); err != nil {
+		t.Fatalf("SetArgEnvVariables: %v", err)
+	}
+	if err := b.SetArgs("--tags=v1.2.3 ./cmd/a ./cmd/b"); err != nil {
+		t.Fatalf("SetArgs: %v", err)
+	}
+
+	attestations, err := b.buildAndAttest(testGitHubContext, AttestationOptions{
+		Mode:          AttestationPerImage,
+		Tokens:        newTestTokenProvider(t, issuer.workflowToken(t, testJobWorkflowRef)),
+		TokenVerifier: NewTokenVerifier(issuer.url),
+	}, withTestRegistry(host))
+	if err != nil {
+		t.Fatalf("BuildAndAttest: %v", err)
+	}
+
+	expectedImages := [][]Image{
+		{{Name: "ghcr.io/org/a", Digest: imageA.Digest}},
+		{{Name: "ghcr.io/org/b", Digest: imageB.Digest}},
+	}
+	expectedFilenames := []string{"ghcr.io-org-a.intoto.jsonl", "ghcr.io-org-b.intoto.jsonl"}
+	if len(attestations) != len(expectedImages) {
+		t.Fatalf("got %d attestations, expected %d", len(attestations), len(expectedImages))
+	}
+
+	for i, att := range attestations {
+		if !cmp.Equal(att.Images, expectedImages[i]) {
+			t.Errorf(cmp.Diff(att.Images, expectedImages[i]))
+		}
+		if att.Filename != expectedFilenames[i] {
+			t.Errorf(cmp.Diff(att.Filename, expectedFilenames[i]))
+		}
+
+		var predicate struct {
+			slsa.ProvenancePredicate
+			BuildConfig BuildConfig `json:"buildConfig"`
+		}
+		if err := json.Unmarshal(att.Content, &predicate); err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+
+		if id := predicate.Builder.ID; id != "https://github.com/"+testJobWorkflowRef {
+			t.Errorf("unexpected builder ID: %s", id)
+		}
+		expectedSteps := []Step{
+			{
+				Command: []string{b.ko, "publish", "--tags=v1.2.3", "./cmd/a", "./cmd/b"},
+				Env:     []string{"GOFLAGS=-trimpath", "KO_DOCKER_REPO=ghcr.io/org"},
+			},
+		}
+		if !cmp.Equal(predicate.BuildConfig.Steps, expectedSteps) {
+			t.Errorf(cmp.Diff(predicate.BuildConfig.Steps, expectedSteps))
+		}
+
+		// The builder's executable and ko are recorded.
+		if len(predicate.Materials) != 3 {
+			t.Fatalf("unexpected materials: %+v", predicate.Materials)
+		}
+		if len(predicate.Materials[1].Digest["sha256"]) != 64 {
+			t.Errorf("unexpected builder material: %+v", predicate.Materials[1])
+		}
+		if uri := predicate.Materials[2].URI; uri != "pkg:golang/github.com/google/ko@v"+testKoVersion {
+			t.Errorf("unexpected ko material: %s", uri)
+		}
+	}
+}
+
+func Test_BuildAndAttest_ldflags(t *testing.T) {
+	t.Parallel()
+
+	// ko copies the configuration it reads.
+	host := newTestRegistry(t)
+	image := pushRandomImage(t, host+"/org/a")
+	dir := t.TempDir()
+	ko := filepath.Join(dir, "ko")
+	config := filepath.Join(dir, "ko.yaml")
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = version ]; then echo %s; exit 0; fi\n"+
+		"cp \"$KO_CONFIG_PATH/.ko.yaml\" %s\necho ghcr.io/org/a@sha256:%s\n", testKoVersion, config, image.Digest)
+	if err := ioutil.WriteFile(ko, []byte(script), 0o700); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	issuer := newTestIssuer(t)
+	b := KoBuildNew(ko)
+	if err := b.SetArgEnvVariables("KO_DOCKER_REPO=ghcr.io/org,KO_CONFIG_PATH=testdata/koconfig/ldflags.yaml"); err != nil {
+		t.Fatalf("SetArgEnvVariables: %v", err)
+	}
+	if err := b.SetArgs("./cmd/a"); err != nil {
+		t.Fatalf("SetArgs: %v", err)
+	}
+
+	attestations, err := b.buildAndAttest(testGitHubContext, AttestationOptions{
+		Tokens:        newTestTokenProvider(t, issuer.workflowToken(t, testJobWorkflowRef)),
+		TokenVerifier: NewTokenVerifier(issuer.url),
+	}, withTestRegistry(host))
+	if err != nil {
+		t.Fatalf("BuildAndAttest: %v", err)
+	}
+
+	var predicate struct {
+		BuildConfig BuildConfig `json:"buildConfig"`
+	}
+	if err := json.Unmarshal(attestations[0].Content, &predicate); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	recorded := predicate.BuildConfig.KoConfig
+	if recorded == nil || recorded.Path != "testdata/koconfig/ldflags.yaml" {
+		t.Fatalf("unexpected ko configuration: %+v", recorded)
+	}
+	expected := []ExpandedLdflag{
+		{
+			Template: "-X main.version={{ .Git.Tag }} -X main.commit={{ .Git.ShortCommit }}",
+			Value:    "-X main.version=v1.2.3 -X main.commit=b54fb2e",
+		},
+		{
+			Template: "-X main.ref={{ .Env.GITHUB_REF_NAME }}",
+			Value:    "-X main.ref=v1.2.3",
+		},
+	}
+	if !cmp.Equal(recorded.ExpandedLdflags, expected) {
+		t.Errorf(cmp.Diff(recorded.ExpandedLdflags, expected))
+	}
+
+	read, err := loadKoConfig(dir, []string{"KO_CONFIG_PATH=ko.yaml"})
+	if err != nil {
+		t.Fatalf("loadKoConfig: %v", err)
+	}
+	expectedLdflags := stringArray{"-s -w", expected[0].Value, expected[1].Value}
+	if ldflags := read.Config.Builds[0].Ldflags; !cmp.Equal(ldflags, expectedLdflags) {
+		t.Errorf(cmp.Diff(ldflags, expectedLdflags))
+	}
+}
+
+func Test_BuildAndAttest_keyless(t *testing.T) {
+	t.Parallel()
+
+	// ko records that it ran.
+	host := newTestRegistry(t)
+	image := pushRandomImage(t, host+"/org/a")
+	dir := t.TempDir()
+	ko := filepath.Join(dir, "ko")
+	published := filepath.Join(dir, "published")
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = version ]; then echo %s; exit 0; fi\n"+
+		"touch %s\necho ghcr.io/org/a@sha256:%s\n", testKoVersion, published, image.Digest)
+	if err := ioutil.WriteFile(ko, []byte(script), 0o700); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// The certificate is requested once the images are published.
+	fake := newFakeFulcio(t)
+	fulcio := fulcioFunc(func(publicKey crypto.PublicKey, proof []byte, token string) ([]byte, error) {
+		if _, err := os.Stat(published); err != nil {
+			return nil, fmt.Errorf("certificate requested before ko ran: %w", err)
+		}
+		return fake.SigningCert(publicKey, proof, token)
+	})
+
+	issuer := newTestIssuer(t)
+	b := KoBuildNew(ko)
+	if err := b.SetArgEnvVariables("KO_DOCKER_REPO=ghcr.io/org"); err != nil {
+		t.Fatalf("SetArgEnvVariables: %v", err)
+	}
+	if err := b.SetArgs("./cmd/a"); err != nil {
+		t.Fatalf("SetArgs: %v", err)
+	}
+
+	attestations, err := b.buildAndAttest(testGitHubContext, AttestationOptions{
+		Format:        FormatStatement,
+		Fulcio:        fulcio,
+		Tokens:        newTestTokenProvider(t, issuer.workflowToken(t, testJobWorkflowRef)),
+		TokenVerifier: NewTokenVerifier(issuer.url),
+	}, withTestRegistry(host))
+	if err != nil {
+		t.Fatalf("BuildAndAttest: %v", err)
+	}
+	if len(attestations) != 1 || len(attestations[0].Certificate) == 0 {
+		t.Errorf("expected a keyless attestation: %+v", attestations)
+	}
+}
+
+func Test_PredicateFilename(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "ghcr.io/org/app", expected: "ghcr.io-org-app.intoto.jsonl"},
+		{name: "localhost:5000/org/app", expected: "localhost--5000-org-app.intoto.jsonl"},
+		{name: "../../etc/passwd", expected: "etc-passwd.intoto.jsonl"},
+		{name: "-app", expected: "app.intoto.jsonl"},
+		{name: "a b\\c\x00", expected: "a_b_c_.intoto.jsonl"},
+		{name: "..", expected: "attestation.intoto.jsonl"},
+		{name: strings.Repeat("a", 300), expected: strings.Repeat("a", maxFilenameLength) + ".intoto.jsonl"},
+	}
+
+	for _, tt := range tests {
+		if f := PredicateFilename(tt.name); f != tt.expected {
+			t.Errorf(cmp.Diff(f, tt.expected))
+		}
+	}
+}
+
+func Test_generateAttestations(t *testing.T) {
+	t.Parallel()
+
+	images := []Image{
+		{Name: "ghcr.io/org/a", Digest: testDigest1},
+		{Name: "ghcr.io/org/b", Digest: testDigest2},
+		{Name: "ghcr.io/org/a", Digest: testDigest2},
+	}
+
+	tests := []struct {
+		name     string
+		images   []Image
+		mode     AttestationMode
+		expected []Attestation
+		err      error
+	}{
+		{
+			name:   "per image",
+			images: images,
+			mode:   AttestationPerImage,
+			expected: []Attestation{
+				{Images: images[0:1], Filename: "ghcr.io-org-a.intoto.jsonl"},
+				{Images: images[1:2], Filename: "ghcr.io-org-b.intoto.jsonl"},
+				{Images: images[2:3], Filename: "ghcr.io-org-a-" + testDigest2[:12] + ".intoto.jsonl"},
+			},
+		},
+		{
+			name:   "combined",
+			images: images,
+			mode:   AttestationCombined,
+			expected: []Attestation{
+				{Images: images, Filename: "ghcr.io-org-a-3-images.intoto.jsonl"},
+			},
+		},
+		{
+			name:   "combined single image",
+			images: images[1:2],
+			mode:   AttestationCombined,
+			expected: []Attestation{
+				{Images: images[1:2], Filename: "ghcr.io-org-b.intoto.jsonl"},
+			},
+		},
+		{
+			name:   "no image",
+			images: nil,
+			mode:   AttestationPerImage,
+			err:    errorNoImage,
+		},
+		{
+			name:   "invalid digest",
+			images: []Image{{Name: "ghcr.io/org/a", Digest: "abc"}},
+			mode:   AttestationCombined,
+			err:    errorInvalidDigest,
+		},
+		{
+			name:   "invalid mode",
+			images: images,
+			mode:   "other",
+			err:    errorInvalidAttestationMode,
+		},
+	}
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			attestations, err := generateAttestations(tt.images, gh,
+				[]string{"ko", "publish"}, nil, testBuilder,
+				AttestationOptions{Mode: tt.mode, Format: FormatPredicate, SLSAVersion: SLSAVersion02})
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			ignoreContent := cmpopts.IgnoreFields(Attestation{}, "Content")
+			if !cmp.Equal(attestations, tt.expected, ignoreContent) {
+				t.Errorf(cmp.Diff(attestations, tt.expected, ignoreContent))
+			}
+		})
+	}
+}
+
+func Test_generateAttestations_platforms(t *testing.T) {
+	t.Parallel()
+
+	host := newTestRegistry(t)
+	index, manifests := pushRandomIndex(t, host+"/org/app",
+		v1.Platform{OS: "linux", Architecture: "amd64"},
+		v1.Platform{OS: "linux", Architecture: "arm64"},
+	)
+	single := pushRandomImage(t, host+"/org/single")
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+
+	tests := []struct {
+		name              string
+		image             Image
+		com               []string
+		env               []string
+		expectedImages    []Image
+		expectedDigests   []string
+		expectedPlatforms []string
+	}{
+		{
+			name:              "requested platforms",
+			image:             index,
+			com:               []string{"ko", "publish", "--platform=linux/amd64,linux/arm64", "./cmd/app"},
+			expectedImages:    []Image{{Name: index.Name, Digest: index.Digest, Manifests: manifests}},
+			expectedDigests:   []string{index.Digest, manifests[0].Digest, manifests[1].Digest},
+			expectedPlatforms: []string{"linux/amd64", "linux/arm64"},
+		},
+		{
+			name:              "default platforms",
+			image:             index,
+			com:               []string{"ko", "publish", "./cmd/app"},
+			env:               []string{"KO_DEFAULTPLATFORMS=linux/amd64,linux/arm64"},
+			expectedImages:    []Image{{Name: index.Name, Digest: index.Digest, Manifests: manifests}},
+			expectedDigests:   []string{index.Digest, manifests[0].Digest, manifests[1].Digest},
+			expectedPlatforms: []string{"linux/amd64", "linux/arm64"},
+		},
+		{
+			name:              "single platform",
+			image:             single,
+			com:               []string{"ko", "publish", "--platform=linux/arm64", "./cmd/app"},
+			expectedImages:    []Image{single},
+			expectedDigests:   []string{single.Digest},
+			expectedPlatforms: []string{"linux/arm64"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			images, err := resolveManifests([]Image{tt.image})
+			if err != nil {
+				t.Fatalf("resolveManifests: %v", err)
+			}
+			attestations, err := generateAttestations(images, gh, tt.com, tt.env, testBuilder,
+				AttestationOptions{
+					Mode:        AttestationCombined,
+					Format:      FormatStatement,
+					SLSAVersion: SLSAVersion02,
+					BaseImages:  BaseImageNone,
+				})
+			if err != nil {
+				t.Fatalf("generateAttestations: %v", err)
+			}
+
+			if !cmp.Equal(attestations[0].Images, tt.expectedImages) {
+				t.Errorf(cmp.Diff(attestations[0].Images, tt.expectedImages))
+			}
+
+			var statement struct {
+				Subject []struct {
+					Name   string            `json:"name"`
+					Digest map[string]string `json:"digest"`
+				} `json:"subject"`
+				Predicate struct {
+					BuildConfig BuildConfig `json:"buildConfig"`
+				} `json:"predicate"`
+			}
+			if err := json.Unmarshal(attestations[0].Content, &statement); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			var digests []string
+			for _, s := range statement.Subject {
+				if s.Name != tt.image.Name {
+					t.Errorf("unexpected subject name: %s", s.Name)
+				}
+				digests = append(digests, s.Digest["sha256"])
+			}
+			if !cmp.Equal(digests, tt.expectedDigests) {
+				t.Errorf(cmp.Diff(digests, tt.expectedDigests))
+			}
+			if platforms := statement.Predicate.BuildConfig.Platforms; !cmp.Equal(platforms, tt.expectedPlatforms) {
+				t.Errorf(cmp.Diff(platforms, tt.expectedPlatforms))
+			}
+		})
+	}
+}
+
+func Test_generateAttestations_perImagePlatforms(t *testing.T) {
+	t.Parallel()
+
+	host := newTestRegistry(t)
+	index, manifests := pushRandomIndex(t, host+"/org/multi",
+		v1.Platform{OS: "linux", Architecture: "amd64"},
+		v1.Platform{OS: "linux", Architecture: "arm64"},
+	)
+	single := pushRandomImage(t, host+"/org/single")
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	images := []Image{{Name: index.Name, Digest: index.Digest, Manifests: manifests}, single}
+	attestations, err := generateAttestations(images, gh,
+		[]string{"ko", "publish", "./cmd/multi", "./cmd/single"},
+		[]string{"KO_DEFAULTPLATFORMS=linux/amd64,linux/arm64"}, testBuilder,
+		AttestationOptions{
+			Mode:        AttestationPerImage,
+			Format:      FormatPredicate,
+			SLSAVersion: SLSAVersion02,
+			BaseImages:  BaseImageNone,
+		})
+	if err != nil {
+		t.Fatalf("generateAttestations: %v", err)
+	}
+
+	// Each provenance records the platforms of its image only.
+	expected := [][]string{{"linux/amd64", "linux/arm64"}, nil}
+	for i, att := range attestations {
+		var predicate struct {
+			BuildConfig BuildConfig `json:"buildConfig"`
+		}
+		if err := json.Unmarshal(att.Content, &predicate); err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		if platforms := predicate.BuildConfig.Platforms; !cmp.Equal(platforms, expected[i]) {
+			t.Errorf("%s: %s", att.Images[0].Name, cmp.Diff(platforms, expected[i]))
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+var (
+	errorInvalidBaseImagePolicy = errors.New("invalid base image policy")
+	errorMutableBaseImage       = errors.New("base image is referenced by tag")
+	errorUnknownBaseImage       = errors.New("unknown base image")
+)
+
+// koDefaultBaseImage returns the base image ko uses when none is
+// configured, which depends on its version: ko v0.12.0 replaced
+// gcr.io/distroless/static:nonroot with cgr.dev/chainguard/static.
+func koDefaultBaseImage(koVersion string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(koVersion, "v"), ".", 3)
+	if len(parts) == 3 {
+		major, errMajor := strconv.Atoi(parts[0])
+		minor, errMinor := strconv.Atoi(parts[1])
+		if errMajor == nil && errMinor == nil {
+			if major == 0 && minor < 12 {
+				return "gcr.io/distroless/static:nonroot", nil
+			}
+			return "cgr.dev/chainguard/static", nil
+		}
+	}
+	return "", fmt.Errorf("%w: the default base image of ko %q is unknown, "+
+		"set KO_DEFAULTBASEIMAGE or defaultBaseImage", errorUnknownBaseImage, koVersion)
+}
+
+// BaseImagePolicy selects whether the base images are recorded in the
+// provenance, and what happens when one is referenced by a mutable tag.
+type BaseImagePolicy string
+
+const (
+	// BaseImageNone does not record the base images.
+	BaseImageNone BaseImagePolicy = "none"
+	// BaseImageWarn records the base images, resolving their tags to
+	// the digests they currently point to with a warning: the tag may
+	// have been updated since ko pulled the image.
+	BaseImageWarn BaseImagePolicy = "warn"
+	// BaseImageFail records the base images and fails when one
+	// is not referenced by digest.
+	BaseImageFail BaseImagePolicy = "fail"
+)
+
+// ParseBaseImagePolicy parses the name of a base image policy.
+// An empty name selects BaseImageNone.
+func ParseBaseImagePolicy(policy string) (BaseImagePolicy, error) {
+	switch BaseImagePolicy(policy) {
+	case "", BaseImageNone:
+		return BaseImageNone, nil
+	case BaseImageWarn:
+		return BaseImageWarn, nil
+	case BaseImageFail:
+		return BaseImageFail, nil
+	default:
+		return "", fmt.Errorf("%w: %s", errorInvalidBaseImagePolicy, policy)
+	}
+}
+
+// baseImage is an image the built binaries are layered onto.
+type baseImage struct {
+	// Name is the repository of the image, e.g., gcr.io/distroless/static.
+	Name string
+	// Digest is the hex-encoded sha256 digest of its manifest,
+	// or of its index for multi-platform images.
+	Digest string
+}
+
+// resolveBaseImages returns the base images of the import paths built by
+// the ko command com with the env variables env and the configuration
+// config, if any, in the Go module in dir. As for ko, the base image of
+// an import path is its baseImageOverrides entry in .ko.yaml, or else
+// KO_DEFAULTBASEIMAGE, or else the defaultBaseImage of .ko.yaml, or
+// else the default of koVersion, which must be known then. Only the env
+// variables recorded in the provenance are considered.
+func resolveBaseImages(dir string, config *KoConfig, com, env []string, koVersion string,
+	policy BaseImagePolicy, opts ...remote.Option) ([]baseImage, error) {
+	if len(com) < 2 {
+		return nil, nil
+	}
+	args, err := koPublishFlagPolicy.parse(com[2:])
+	if err != nil {
+		return nil, err
+	}
+	if len(args.importPaths) == 0 {
+		return nil, nil
+	}
+
+	if config == nil {
+		config = &KoConfig{}
+	}
+
+	base := config.DefaultBaseImage
+	for _, e := range env {
+		if v := strings.TrimPrefix(e, "KO_DEFAULTBASEIMAGE="); v != e {
+			base = v
+		}
+	}
+
+	var (
+		images     []baseImage
+		modulePath string
+	)
+	seen := make(map[string]bool)
+	for _, p := range args.importPaths {
+		p = strings.TrimPrefix(p, "ko://")
+		if strings.HasPrefix(p, ".") {
+			if modulePath == "" {
+				modulePath, err = readModulePath(dir)
+				if err != nil {
+					return nil, err
+				}
+			}
+			p = path.Join(modulePath, p)
+		}
+
+		ref := base
+		if override, ok := config.BaseImageOverrides[p]; ok {
+			ref = override
+		}
+		if ref == "" {
+			ref, err = koDefaultBaseImage(koVersion)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+		}
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+
+		image, err := resolveBaseImage(ref, policy, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// resolveBaseImage returns the base image referenced by ref,
+// resolving its tag if the policy allows it.
+func resolveBaseImage(ref string, policy BaseImagePolicy, opts ...remote.Option) (baseImage, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return baseImage{}, fmt.Errorf("%w: %s: %v", errorInvalidImage, ref, err)
+	}
+
+	d, ok := r.(name.Digest)
+	if !ok {
+		if policy != BaseImageWarn {
+			return baseImage{}, fmt.Errorf("%w: %s", errorMutableBaseImage, ref)
+		}
+		fmt.Fprintf(os.Stderr, "warning: base image %s is referenced by tag, recording its current digest\n", ref)
+		d, err = resolveDigest(ref, opts...)
+		if err != nil {
+			return baseImage{}, err
+		}
+	}
+
+	digest := strings.TrimPrefix(d.DigestStr(), "sha256:")
+	if err := validateDigest(digest); err != nil {
+		return baseImage{}, err
+	}
+	return baseImage{Name: r.Context().Name(), Digest: digest}, nil
+}
@@ -0,0 +1,206 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_resolveBaseImages(t *testing.T) {
+	t.Parallel()
+
+	host := newTestRegistry(t)
+	base := pushRandomImage(t, host+"/base/static")
+	debug := pushRandomImage(t, host+"/base/debug")
+	baseTag := host + "/base/static:latest"
+	baseDigest := host + "/base/static@sha256:" + base.Digest
+	debugDigest := host + "/base/debug@sha256:" + debug.Digest
+
+	// withKoConfig writes a Go module with the .ko.yaml.
+	withKoConfig := func(config string) string {
+		dir := writeGoModule(t, "module example.com/app\n\ngo 1.17\n", nil)
+		if err := ioutil.WriteFile(filepath.Join(dir, koConfigFilename), []byte(config), 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return dir
+	}
+
+	tests := []struct {
+		name     string
+		dir      string
+		com      []string
+		env      []string
+		ko       string
+		policy   BaseImagePolicy
+		expected []baseImage
+		err      error
+	}{
+		{
+			name:   "env by digest",
+			dir:    t.TempDir(),
+			com:    []string{"ko", "publish", "example.com/app/cmd/a"},
+			env:    []string{"KO_DEFAULTBASEIMAGE=" + baseDigest},
+			policy: BaseImageFail,
+			expected: []baseImage{
+				{Name: host + "/base/static", Digest: base.Digest},
+			},
+		},
+		{
+			name:   "env overrides config",
+			dir:    withKoConfig("defaultBaseImage: " + debugDigest + "\n"),
+			com:    []string{"ko", "publish", "./cmd/a"},
+			env:    []string{"KO_DEFAULTBASEIMAGE=" + baseDigest},
+			policy: BaseImageFail,
+			expected: []baseImage{
+				{Name: host + "/base/static", Digest: base.Digest},
+			},
+		},
+		{
+			name: "override per import path",
+			dir: withKoConfig("defaultBaseImage: " + baseDigest + "\n" +
+				"baseImageOverrides:\n  example.com/app/cmd/b: " + debugDigest + "\n"),
+			com:    []string{"ko", "publish", "--tags=v1", "./cmd/a", "ko://example.com/app/cmd/b", "./cmd/c"},
+			policy: BaseImageFail,
+			expected: []baseImage{
+				{Name: host + "/base/static", Digest: base.Digest},
+				{Name: host + "/base/debug", Digest: debug.Digest},
+			},
+		},
+		{
+			name:   "tag resolved with a warning",
+			dir:    t.TempDir(),
+			com:    []string{"ko", "publish", "example.com/app/cmd/a"},
+			env:    []string{"KO_DEFAULTBASEIMAGE=" + baseTag},
+			policy: BaseImageWarn,
+			expected: []baseImage{
+				{Name: host + "/base/static", Digest: base.Digest},
+			},
+		},
+		{
+			name:   "tag",
+			dir:    t.TempDir(),
+			com:    []string{"ko", "publish", "example.com/app/cmd/a"},
+			env:    []string{"KO_DEFAULTBASEIMAGE=" + baseTag},
+			policy: BaseImageFail,
+			err:    errorMutableBaseImage,
+		},
+		{
+			name:   "default base image",
+			dir:    t.TempDir(),
+			com:    []string{"ko", "publish", "example.com/app/cmd/a"},
+			ko:     testKoVersion,
+			policy: BaseImageFail,
+			err:    errorMutableBaseImage,
+		},
+		{
+			name:   "default base image of an unknown ko",
+			dir:    t.TempDir(),
+			com:    []string{"ko", "publish", "example.com/app/cmd/a"},
+			policy: BaseImageWarn,
+			err:    errorUnknownBaseImage,
+		},
+		{
+			name:   "all import paths overridden with an unknown ko",
+			dir:    withKoConfig("baseImageOverrides:\n  example.com/app/cmd/a: " + debugDigest + "\n"),
+			com:    []string{"ko", "publish", "./cmd/a"},
+			policy: BaseImageFail,
+			expected: []baseImage{
+				{Name: host + "/base/debug", Digest: debug.Digest},
+			},
+		},
+		{
+			name:   "no import path",
+			dir:    t.TempDir(),
+			com:    []string{"ko", "publish"},
+			policy: BaseImageFail,
+		},
+		{
+			name:   "relative import path outside a module",
+			dir:    t.TempDir(),
+			com:    []string{"ko", "publish", "./cmd/a"},
+			env:    []string{"KO_DEFAULTBASEIMAGE=" + baseDigest},
+			policy: BaseImageFail,
+			err:    errorInvalidGoModule,
+		},
+		{
+			name:   "invalid reference",
+			dir:    t.TempDir(),
+			com:    []string{"ko", "publish", "example.com/app/cmd/a"},
+			env:    []string{"KO_DEFAULTBASEIMAGE=Invalid Image"},
+			policy: BaseImageWarn,
+			err:    errorInvalidImage,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var config *KoConfig
+			file, err := loadKoConfig(tt.dir, tt.env)
+			if err != nil {
+				t.Fatalf("loadKoConfig: %v", err)
+			}
+			if file != nil {
+				config = &file.Config
+			}
+
+			images, err := resolveBaseImages(tt.dir, config, tt.com, tt.env, tt.ko, tt.policy)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if !cmp.Equal(images, tt.expected) {
+				t.Errorf(cmp.Diff(images, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_koDefaultBaseImage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		version  string
+		expected string
+		err      error
+	}{
+		{version: "0.11.2", expected: "gcr.io/distroless/static:nonroot"},
+		{version: "v0.9.3", expected: "gcr.io/distroless/static:nonroot"},
+		{version: "0.12.0", expected: "cgr.dev/chainguard/static"},
+		{version: "v0.15.1", expected: "cgr.dev/chainguard/static"},
+		{version: "", err: errorUnknownBaseImage},
+		{version: "(devel)", err: errorUnknownBaseImage},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.version, func(t *testing.T) {
+			t.Parallel()
+
+			image, err := koDefaultBaseImage(tt.version)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if image != tt.expected {
+				t.Errorf(cmp.Diff(image, tt.expected))
+			}
+		})
+	}
+}
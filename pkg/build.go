@@ -20,8 +20,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
@@ -34,38 +36,48 @@ var (
 	errorInvalidRegistry           = errors.New("invalid registry")
 )
 
-var dockerRegistry = "docker.io"
-
 type KoBuild struct {
-	ko   string
-	args []string
-	envs map[string]string
+	ko         string
+	args       []string
+	envs       map[string]string
+	flagPolicy flagPolicy
+	envPolicy  EnvPolicy
+	// gh is the GitHub context templates are expanded with, if set.
+	gh *gitHubContext
+	// date is the time templates are expanded with. It is set once,
+	// when first needed, unless SetDate pins it.
+	date time.Time
+	// koConfigDir is the directory of the expanded ko configuration
+	// that ko reads instead of the repository's, if any.
+	koConfigDir string
 }
 
 func KoBuildNew(ko string) *KoBuild {
 	c := KoBuild{
-		ko:   ko,
-		envs: make(map[string]string),
-		args: make([]string, 0),
+		ko:         ko,
+		envs:       make(map[string]string),
+		args:       make([]string, 0),
+		flagPolicy: koPublishFlagPolicy,
+		envPolicy:  DefaultEnvPolicy(),
 	}
 
 	return &c
 }
 
 func (b *KoBuild) Run(dry bool) error {
-	fmt.Println("Run")
+	fmt.Fprintln(os.Stderr, "Run")
 
 	command, err := b.generateCommandArgs()
 	if err != nil {
 		return err
 	}
 
-	envs, err := b.generateEnvVariables()
+	registry, err := b.generateRegistry()
 	if err != nil {
 		return err
 	}
 
-	registry, err := b.generateRegistry()
+	config, err := b.koConfig()
 	if err != nil {
 		return err
 	}
@@ -91,81 +103,236 @@ func (b *KoBuild) Run(dry bool) error {
 		}
 		fmt.Printf("::set-output name=envs::%s\n", envs)
 
-		fmt.Printf("::set-output name=registry::%s\n", registry)
+		fmt.Printf("::set-output name=registry::%s\n", registry.Address())
+
+		// Share the configuration with its expanded ldflags, which the
+		// predicate records, and the date they are expanded with, which
+		// the build must reuse to expand them identically.
+		if config != nil {
+			encoded, err := config.marshal()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("::set-output name=ko-config::%s\n", encoded)
+		}
+		fmt.Printf("::set-output name=date::%s\n", b.buildDate().Format(time.RFC3339))
 
 		return nil
 	}
 
-	fmt.Println("command", command)
-	fmt.Println("env", envs)
-	fmt.Println("registry", registry)
+	// The expanded configuration is not removed,
+	// since ko replaces the builder's process.
+	if _, err := b.useExpandedKoConfig(config); err != nil {
+		return err
+	}
+
+	envs, err := b.generateEnvVariables()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "command", command)
+	fmt.Fprintln(os.Stderr, "env", envs)
+	fmt.Fprintln(os.Stderr, "registry", registry.Address())
 	return syscall.Exec(b.ko, command, envs)
 }
 
-func (b *KoBuild) SetArgs(args string) error {
-	if args == "" {
-		return nil
+// SetGitHubContext sets the GitHub context, as the JSON of the
+// `github` context of the workflow, that the templated ldflags of the
+// ko configuration are expanded with. Without it, templated ldflags
+// are rejected.
+func (b *KoBuild) SetGitHubContext(ghContext string) error {
+	gh, err := parseGitHubContext(ghContext)
+	if err != nil {
+		return err
+	}
+	b.gh = gh
+	return nil
+}
+
+// SetDate pins the time templates are expanded with, in RFC 3339
+// format, as output by the dry run.
+func (b *KoBuild) SetDate(date string) error {
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return fmt.Errorf("%w: date: %v", errorInvalidTemplate, err)
+	}
+	b.date = t.UTC()
+	return nil
+}
+
+// buildDate returns the time templates are expanded with.
+func (b *KoBuild) buildDate() time.Time {
+	if b.date.IsZero() {
+		b.date = time.Now().UTC().Truncate(time.Second)
 	}
+	return b.date
+}
 
-	for _, arg := range strings.Split(args, " ") {
-		arg = strings.Trim(arg, " ")
+// koConfig returns the ko configuration file, which ko reads from the
+// working directory, checked against the policies of the builder and
+// with its templated ldflags expanded. It returns nil if there is none.
+func (b *KoBuild) koConfig() (*KoConfigFile, error) {
+	env, err := b.generateCommandEnvVariables()
+	if err != nil {
+		return nil, err
+	}
 
-		fmt.Printf("arg: %s\n", arg)
-		b.args = append(b.args, arg)
+	config, err := loadKoConfig(".", env)
+	if err != nil || config == nil {
+		return nil, err
+	}
+	if err := config.Config.validate(b.envPolicy); err != nil {
+		return nil, err
+	}
 
+	var data *templateData
+	if b.gh != nil {
+		d := newTemplateData(b.gh, b.buildDate())
+		data = &d
 	}
-	return nil
+	if err := config.expandLdflags(data); err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
-func (b *KoBuild) generateEnvVariables() ([]string, error) {
-	env := os.Environ()
+// useExpandedKoConfig makes ko read the configuration with its templated
+// ldflags expanded, if it has any. The returned function removes it.
+func (b *KoBuild) useExpandedKoConfig(config *KoConfigFile) (func(), error) {
+	if config == nil || len(config.ExpandedLdflags) == 0 {
+		return func() {}, nil
+	}
 
-	cenv, err := b.generateCommandEnvVariables()
+	dir, err := config.writeExpanded()
 	if err != nil {
-		return cenv, err
+		return nil, err
 	}
+	b.koConfigDir = dir
+	return func() {
+		os.RemoveAll(dir)
+		b.koConfigDir = ""
+	}, nil
+}
 
-	env = append(env, cenv...)
+// SetEnvPolicy replaces the policy that env variables
+// passed to SetArgEnvVariables must satisfy.
+func (b *KoBuild) SetEnvPolicy(p EnvPolicy) {
+	b.envPolicy = p
+}
 
-	return env, nil
+// SetArgs sets the arguments for ko from a command line string.
+// The string is tokenized with POSIX shell quoting rules,
+// see splitArgs.
+func (b *KoBuild) SetArgs(args string) error {
+	if args == "" {
+		return nil
+	}
+
+	list, err := splitArgs(args)
+	if err != nil {
+		return err
+	}
+
+	return b.setArgList(list)
 }
 
-func (b *KoBuild) generateCommandEnvVariables() ([]string, error) {
-	var env []string
+// SetArgsList sets the arguments for ko from a base64-encoded
+// JSON list, as generated by marshallList. This lets callers pass
+// the exact argv without relying on shell quoting.
+func (b *KoBuild) SetArgsList(args string) error {
+	list, err := unmarshallList(args)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errorInvalidArgument, err)
+	}
+
+	return b.setArgList(list)
+}
 
-	// Set env variables from config file.
-	for k, v := range b.envs {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
+func (b *KoBuild) setArgList(args []string) error {
+	// Validate the arguments as a whole, since a flag's value
+	// may be a separate argument.
+	all := append(append([]string{}, b.args...), args...)
+	if _, err := b.flagPolicy.parse(all); err != nil {
+		return err
 	}
 
-	return env, nil
+	for _, arg := range args {
+		fmt.Fprintf(os.Stderr, "arg: %s\n", arg)
+		b.args = append(b.args, arg)
+	}
+	return nil
+}
+
+// inheritedEnvVariables are the env variables of the builder that ko
+// and the Go toolchain need. The others, e.g., the variables that
+// request OIDC tokens and the signing secrets, are not passed to ko,
+// since the build runs code that the builder does not trust.
+var inheritedEnvVariables = []string{
+	"PATH", "HOME", "USER", "TMPDIR", "LANG",
+	"GOROOT", "GOPATH", "GOCACHE", "GOMODCACHE", "GOTOOLCHAIN",
+	"DOCKER_CONFIG", "SSL_CERT_FILE", "SSL_CERT_DIR",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
 }
 
-func (b *KoBuild) generateRegistry() (string, error) {
-	var registry string
-	for k, v := range b.envs {
-		if k == "KO_DOCKER_REPO" {
-			registry = v
+// builderEnvVariables returns the env variables of the builder
+// that ko inherits, see inheritedEnvVariables.
+func builderEnvVariables() []string {
+	var env []string
+	for _, name := range inheritedEnvVariables {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
 		}
 	}
+	return env
+}
+
+// generateEnvVariables returns the env variables ko is run with: those
+// of the builder it inherits and those set by the caller. The builder's
+// take precedence, as does the expanded ko configuration over the
+// KO_CONFIG_PATH set by the caller. No variable is duplicated, since
+// syscall.Exec, used by Run, passes all of them and ko reads the first,
+// while exec.Cmd, used by publish, keeps the last.
+func (b *KoBuild) generateEnvVariables() ([]string, error) {
+	env := builderEnvVariables()
+	if b.koConfigDir != "" {
+		env = append(env, koConfigPathEnvKey+"="+b.koConfigDir)
+	}
+
+	cenv, err := b.generateCommandEnvVariables()
+	if err != nil {
+		return cenv, err
+	}
 
-	// Empty registry is allowed, default to docker.
-	if registry == "" {
-		return dockerRegistry, nil
+	set := make(map[string]bool, len(env))
+	for _, e := range env {
+		set[strings.SplitN(e, "=", 2)[0]] = true
+	}
+	for _, e := range cenv {
+		if !set[strings.SplitN(e, "=", 2)[0]] {
+			env = append(env, e)
+		}
 	}
 
-	parts := strings.Split(registry, "/")
-	if len(parts) > 2 {
-		return "", fmt.Errorf("%w: %s", errorInvalidRegistry, registry)
+	return env, nil
+}
+
+// generateCommandEnvVariables returns the env variables set by the caller,
+// sorted by name so that the dry run output and the provenance are
+// identical across runs.
+func (b *KoBuild) generateCommandEnvVariables() ([]string, error) {
+	names := make([]string, 0, len(b.envs))
+	for k := range b.envs {
+		names = append(names, k)
 	}
+	sort.Strings(names)
 
-	// A non-separated string indicates a docker username
-	// https://github.com/google/ko#choose-destination.
-	if len(parts) == 1 {
-		return dockerRegistry, nil
+	var env []string
+	for _, k := range names {
+		env = append(env, fmt.Sprintf("%s=%s", k, b.envs[k]))
 	}
 
-	return strings.Trim(parts[0], " "), nil
+	return env, nil
 }
 
 func marshallList(args []string) (string, error) {
@@ -190,24 +357,53 @@ func (b *KoBuild) generateCommandArgs() ([]string, error) {
 	return flags, nil
 }
 
+// SetArgEnvVariables sets the env variables for ko from a
+// comma-separated list of NAME=VALUE entries, see parseEnvList.
 func (b *KoBuild) SetArgEnvVariables(envs string) error {
 	if envs == "" {
 		return nil
 	}
 
-	for _, e := range strings.Split(envs, ",") {
-		s := strings.Trim(e, " ")
+	list, err := parseEnvList(envs)
+	if err != nil {
+		return err
+	}
+
+	return b.setEnvVariables(list)
+}
+
+// SetArgEnvVariablesList sets the env variables for ko from a
+// base64-encoded JSON list of NAME=VALUE entries, as generated by
+// marshallList for the `envs` output of a dry run.
+func (b *KoBuild) SetArgEnvVariablesList(envs string) error {
+	entries, err := unmarshallList(envs)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errorInvalidEnvArgument, err)
+	}
 
-		sp := strings.Split(s, "=")
+	list := make([]envVariable, 0, len(entries))
+	for _, e := range entries {
+		sp := strings.SplitN(e, "=", 2)
 		if len(sp) != 2 {
-			return fmt.Errorf("%w: %s", errorInvalidEnvArgument, s)
+			return fmt.Errorf("%w: %s", errorInvalidEnvArgument, e)
 		}
-		name := strings.Trim(sp[0], " ")
-		value := strings.Trim(sp[1], " ")
+		list = append(list, envVariable{name: sp[0], value: sp[1]})
+	}
+
+	return b.setEnvVariables(list)
+}
 
-		fmt.Printf("arg env: %s:%s\n", name, value)
-		b.envs[name] = value
+func (b *KoBuild) setEnvVariables(list []envVariable) error {
+	// Validate all the variables before recording any.
+	for _, e := range list {
+		if err := b.envPolicy.check(e.name, e.value); err != nil {
+			return err
+		}
+	}
 
+	for _, e := range list {
+		fmt.Fprintf(os.Stderr, "arg env: %s:%s\n", e.name, e.value)
+		b.envs[e.name] = e.value
 	}
 	return nil
 }
@@ -17,9 +17,11 @@ package pkg
 import (
 	"errors"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -92,13 +94,13 @@ func Test_generateCommandEnvVariables(t *testing.T) {
 			},
 		},
 		{
-			name: "valid env",
-			env:  []string{"VAR1=value1", "VAR2=value2"},
+			name: "valid env KO",
+			env:  []string{"KO_DOCKER_REPO=ghcr.io/org", "KO_DEFAULTBASEIMAGE=alpine"},
 			expected: struct {
 				err   error
 				flags []string
 			}{
-				flags: []string{"VAR1=value1", "VAR2=value2"},
+				flags: []string{"KO_DOCKER_REPO=ghcr.io/org", "KO_DEFAULTBASEIMAGE=alpine"},
 			},
 		},
 		{
@@ -136,8 +138,8 @@ func Test_generateCommandEnvVariables(t *testing.T) {
 			if err != nil {
 				return
 			}
-			// Note: generated env variables contain the process's env variables too.
-			expectedFlags := append(os.Environ(), tt.expected.flags...)
+			// Note: generated env variables contain the process's inherited env variables too.
+			expectedFlags := append(builderEnvVariables(), tt.expected.flags...)
 			sorted := cmpopts.SortSlices(func(a, b string) bool { return a < b })
 			if !cmp.Equal(flags, expectedFlags, sorted) {
 				t.Errorf(cmp.Diff(flags, expectedFlags))
@@ -159,13 +161,13 @@ func Test_SetArgEnvVariables(t *testing.T) {
 	}{
 		{
 			name:   "valid arg envs",
-			argEnv: "VAR1=value1, VAR2=value2",
+			argEnv: "GOVAR1=value1, GOVAR2=value2",
 			expected: struct {
 				err error
 				env map[string]string
 			}{
 				err: nil,
-				env: map[string]string{"VAR1": "value1", "VAR2": "value2"},
+				env: map[string]string{"GOVAR1": "value1", "GOVAR2": "value2"},
 			},
 		},
 		{
@@ -181,18 +183,18 @@ func Test_SetArgEnvVariables(t *testing.T) {
 		},
 		{
 			name:   "valid arg envs not space",
-			argEnv: "VAR1=value1,VAR2=value2",
+			argEnv: "GOVAR1=value1,GOVAR2=value2",
 			expected: struct {
 				err error
 				env map[string]string
 			}{
 				err: nil,
-				env: map[string]string{"VAR1": "value1", "VAR2": "value2"},
+				env: map[string]string{"GOVAR1": "value1", "GOVAR2": "value2"},
 			},
 		},
 		{
 			name:   "invalid arg empty 2 values",
-			argEnv: "VAR1=value1,",
+			argEnv: "GOVAR1=value1,",
 			expected: struct {
 				err error
 				env map[string]string
@@ -202,7 +204,7 @@ func Test_SetArgEnvVariables(t *testing.T) {
 		},
 		{
 			name:   "invalid arg empty 3 values",
-			argEnv: "VAR1=value1,, VAR3=value3",
+			argEnv: "GOVAR1=value1,, GOVAR3=value3",
 			expected: struct {
 				err error
 				env map[string]string
@@ -212,7 +214,7 @@ func Test_SetArgEnvVariables(t *testing.T) {
 		},
 		{
 			name:   "invalid arg uses :",
-			argEnv: "VAR1:value1",
+			argEnv: "GOVAR1:value1",
 			expected: struct {
 				err error
 				env map[string]string
@@ -222,18 +224,91 @@ func Test_SetArgEnvVariables(t *testing.T) {
 		},
 		{
 			name:   "valid single arg",
-			argEnv: "VAR1=value1",
+			argEnv: "GOVAR1=value1",
 			expected: struct {
 				err error
 				env map[string]string
 			}{
 				err: nil,
-				env: map[string]string{"VAR1": "value1"},
+				env: map[string]string{"GOVAR1": "value1"},
+			},
+		},
+		{
+			name:   "valid single arg with trailing equal",
+			argEnv: "GOVAR1=value1=",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"GOVAR1": "value1="},
+			},
+		},
+		{
+			name:   "valid empty value",
+			argEnv: "GOVAR1=,GOVAR2=\"\"",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"GOVAR1": "", "GOVAR2": ""},
+			},
+		},
+		{
+			name:   "valid values with equal",
+			argEnv: "GOFLAGS=-ldflags=-X=main.v=1, GOVAR2=a=b",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"GOFLAGS": "-ldflags=-X=main.v=1", "GOVAR2": "a=b"},
+			},
+		},
+		{
+			name:   "valid double quoted value with comma",
+			argEnv: `GOFLAGS="-tags=a,b -trimpath",KO_DEFAULTBASEIMAGE=gcr.io/x@sha256:abc`,
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{
+					"GOFLAGS":             "-tags=a,b -trimpath",
+					"KO_DEFAULTBASEIMAGE": "gcr.io/x@sha256:abc",
+				},
+			},
+		},
+		{
+			name:   "valid single quoted value",
+			argEnv: `GOVAR1=' a,"b" ', GOVAR2="a\"b\\c"`,
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"GOVAR1": ` a,"b" `, "GOVAR2": `a"b\c`},
+			},
+		},
+		{
+			name:   "valid escaped comma",
+			argEnv: `GOVAR1=a\,b\ ,GOVAR2=c`,
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"GOVAR1": "a,b ", "GOVAR2": "c"},
+			},
+		},
+		{
+			name:   "invalid quoted equal",
+			argEnv: `GOVAR1"="value1`,
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorInvalidEnvArgument,
 			},
 		},
 		{
-			name:   "invalid valid single arg with empty",
-			argEnv: "VAR1=value1=",
+			name:   "invalid unterminated quote",
+			argEnv: `GOVAR1="value1,GOVAR2=value2`,
 			expected: struct {
 				err error
 				env map[string]string
@@ -241,6 +316,327 @@ func Test_SetArgEnvVariables(t *testing.T) {
 				err: errorInvalidEnvArgument,
 			},
 		},
+		{
+			name:   "invalid trailing backslash",
+			argEnv: `GOVAR1=value1\`,
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorInvalidEnvArgument,
+			},
+		},
+		{
+			name:   "invalid empty name",
+			argEnv: "=value1",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameEmpty,
+			},
+		},
+		{
+			name:   "invalid name",
+			argEnv: "GO VAR=value1",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorInvalidEnvArgument,
+			},
+		},
+		{
+			name:   "valid prefixes",
+			argEnv: "GOOS=linux,CGO_ENABLED=0,KO_DOCKER_REPO=ghcr.io/org",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"GOOS": "linux", "CGO_ENABLED": "0", "KO_DOCKER_REPO": "ghcr.io/org"},
+			},
+		},
+		{
+			name:   "not allowed name",
+			argEnv: "VAR1=value1",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "not allowed CGO prefix",
+			argEnv: "CGOVAR=value1",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied LD_PRELOAD",
+			argEnv: "LD_PRELOAD=/tmp/lib.so",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied PATH",
+			argEnv: "GOOS=linux,PATH=/tmp",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "KO_CONFIG_PATH in the repository",
+			argEnv: "KO_CONFIG_PATH=config/.ko.yaml",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: nil,
+				env: map[string]string{"KO_CONFIG_PATH": "config/.ko.yaml"},
+			},
+		},
+		{
+			name:   "denied KO_CONFIG_PATH",
+			argEnv: "KO_CONFIG_PATH=/tmp/.ko.yaml",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied KO_CONFIG_PATH outside the repository",
+			argEnv: "KO_CONFIG_PATH=../.ko.yaml",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GOTOOLCHAIN",
+			argEnv: "GOTOOLCHAIN=go1.99",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "valid GOFLAGS",
+			argEnv: "GOFLAGS=-trimpath -race",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"GOFLAGS": "-trimpath -race"},
+			},
+		},
+		{
+			name:   "denied GOFLAGS toolexec",
+			argEnv: "GOFLAGS=-trimpath --toolexec",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GOFLAGS extld",
+			argEnv: "GOFLAGS=-trimpath -ldflags=-extld=/tmp/ld",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GOFLAGS extldflags with a pattern",
+			argEnv: "GOFLAGS=-ldflags=all=-extldflags=-B/tmp",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "valid GOFLAGS ldflags",
+			argEnv: "GOFLAGS=-ldflags=-s",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"GOFLAGS": "-ldflags=-s"},
+			},
+		},
+		{
+			name:   "denied GOCACHE",
+			argEnv: "GOCACHE=./cache",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GOMODCACHE",
+			argEnv: "GOMODCACHE=./cache",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GOPATH",
+			argEnv: "GOPATH=./cache",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GOSUMDB",
+			argEnv: "GOSUMDB=off",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GONOSUMDB",
+			argEnv: "GONOSUMDB=*",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GOINSECURE",
+			argEnv: "GOINSECURE=*",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GOFLAGS mod=mod",
+			argEnv: "GOFLAGS=-trimpath -mod=mod",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied GOFLAGS mod mod",
+			argEnv: "GOFLAGS=-mod mod",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "valid GOFLAGS mod=vendor",
+			argEnv: "GOFLAGS=-mod=vendor",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"GOFLAGS": "-mod=vendor"},
+			},
+		},
+		{
+			name:   "denied KO_GO_PATH",
+			argEnv: "KO_GO_PATH=/tmp/go",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "valid CGO_CFLAGS",
+			argEnv: "CGO_ENABLED=1,CGO_CFLAGS=-O2 -g",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				env: map[string]string{"CGO_ENABLED": "1", "CGO_CFLAGS": "-O2 -g"},
+			},
+		},
+		{
+			name:   "denied CGO_CFLAGS wrapper",
+			argEnv: "CGO_CFLAGS=-O2 -wrapper /tmp/x",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied CGO_LDFLAGS tool directory",
+			argEnv: "CGO_LDFLAGS=-B/tmp",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied CGO_LDFLAGS response file",
+			argEnv: "CGO_LDFLAGS=@/tmp/flags",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
+		{
+			name:   "denied CGO_CFLAGS_ALLOW",
+			argEnv: "CGO_CFLAGS_ALLOW=-fplugin=.*",
+			expected: struct {
+				err error
+				env map[string]string
+			}{
+				err: errorEnvVariableNameNotAllowed,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -267,6 +663,102 @@ func Test_SetArgEnvVariables(t *testing.T) {
 	}
 }
 
+// Test_generateEnvVariables_secrets is not parallel, since it sets
+// the env variables of the process.
+func Test_generateEnvVariables_secrets(t *testing.T) {
+	secrets := []string{
+		"ACTIONS_ID_TOKEN_REQUEST_TOKEN", "ACTIONS_ID_TOKEN_REQUEST_URL",
+		"ACTIONS_RUNTIME_TOKEN", "COSIGN_PASSWORD", "GITHUB_TOKEN", "GITHUB_CONTEXT",
+	}
+	for _, name := range secrets {
+		t.Setenv(name, "secret")
+	}
+	t.Setenv("PATH", "/usr/bin:/bin")
+
+	b := KoBuildNew("ko")
+	if err := b.SetArgEnvVariables("KO_DOCKER_REPO=ghcr.io/org"); err != nil {
+		t.Fatalf("SetArgEnvVariables: %v", err)
+	}
+	env, err := b.generateEnvVariables()
+	if err != nil {
+		t.Fatalf("generateEnvVariables: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, e := range env {
+		names[strings.SplitN(e, "=", 2)[0]] = true
+	}
+	for _, name := range secrets {
+		if names[name] {
+			t.Errorf("%s is passed to ko", name)
+		}
+	}
+	for _, name := range []string{"PATH", "KO_DOCKER_REPO"} {
+		if !names[name] {
+			t.Errorf("%s is not passed to ko", name)
+		}
+	}
+}
+
+// Test_generateEnvVariables_precedence is not parallel, since it sets
+// the env variables of the builder.
+func Test_generateEnvVariables_precedence(t *testing.T) {
+	t.Setenv("GOPATH", "/builder/go")
+
+	// ko writes the env variables it is run with.
+	dir := t.TempDir()
+	ko := filepath.Join(dir, "ko")
+	written := filepath.Join(dir, "env")
+	script := fmt.Sprintf("#!/bin/sh\nenv > %s\necho ghcr.io/org/a@sha256:%s\n", written, testDigest1)
+	if err := ioutil.WriteFile(ko, []byte(script), 0o700); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	b := KoBuildNew(ko)
+	b.SetEnvPolicy(EnvPolicy{Allow: []string{"*"}})
+	if err := b.SetArgEnvVariables("GOPATH=/caller/go,KO_CONFIG_PATH=.ko.yaml,KO_DOCKER_REPO=ghcr.io/org"); err != nil {
+		t.Fatalf("SetArgEnvVariables: %v", err)
+	}
+	b.koConfigDir = "/tmp/expanded"
+
+	// Run passes the variables as they are.
+	env, err := b.generateEnvVariables()
+	if err != nil {
+		t.Fatalf("generateEnvVariables: %v", err)
+	}
+	// publish passes them through exec.Cmd.
+	if _, err := b.publish([]string{ko, "publish"}, env); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	content, err := ioutil.ReadFile(written)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	expected := map[string]string{
+		"GOPATH":         "/builder/go",
+		"KO_CONFIG_PATH": "/tmp/expanded",
+		"KO_DOCKER_REPO": "ghcr.io/org",
+	}
+	for path, vars := range map[string][]string{
+		"Run":     env,
+		"publish": strings.Split(strings.TrimSpace(string(content)), "\n"),
+	} {
+		values := make(map[string][]string)
+		for _, e := range vars {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) == 2 {
+				values[kv[0]] = append(values[kv[0]], kv[1])
+			}
+		}
+		for name, value := range expected {
+			if !cmp.Equal(values[name], []string{value}) {
+				t.Errorf("%s: %s", path, cmp.Diff(values[name], []string{value}))
+			}
+		}
+	}
+}
+
 func Test_generateCommandArgs(t *testing.T) {
 	t.Parallel()
 
@@ -277,13 +769,18 @@ func Test_generateCommandArgs(t *testing.T) {
 	}{
 		{
 			name:     "valid flags",
-			args:     "-race -x",
-			expected: []string{"-race", "-x"},
+			args:     "--disable-optimizations -t latest",
+			expected: []string{"--disable-optimizations", "-t", "latest"},
 		},
 		{
 			name:     "valid all flags",
-			args:     "-a -race -msan -asan -ldflags -linkshared",
-			expected: []string{"-a", "-race", "-msan", "-asan", "-ldflags", "-linkshared"},
+			args:     "--tags=v1 --platform=linux/amd64 --image-label=a=b --sbom=none -j 2 --push ./cmd",
+			expected: []string{"--tags=v1", "--platform=linux/amd64", "--image-label=a=b", "--sbom=none", "-j", "2", "--push", "./cmd"},
+		},
+		{
+			name:     "quoted flags",
+			args:     `--tags="a b"  --image-label='org.opencontainers.image.title=my app'`,
+			expected: []string{"--tags=a b", "--image-label=org.opencontainers.image.title=my app"},
 		},
 	}
 
@@ -320,37 +817,92 @@ func Test_generateRegistry(t *testing.T) {
 	tests := []struct {
 		name     string
 		input    string
-		expected string
+		expected Registry
 		err      error
 	}{
+		{
+			name:     "empty registry",
+			input:    "",
+			expected: Registry{Host: "docker.io"},
+		},
 		{
 			name:     "docker registry",
 			input:    "docker.io/username",
-			expected: "docker.io",
+			expected: Registry{Host: "docker.io", Repository: "username"},
+		},
+		{
+			name:     "index docker registry",
+			input:    "index.docker.io/username/repo",
+			expected: Registry{Host: "docker.io", Repository: "username/repo"},
 		},
 		{
 			name:     "default docker registry",
 			input:    "username",
-			expected: "docker.io",
+			expected: Registry{Host: "docker.io", Repository: "username"},
+		},
+		{
+			name:     "default docker registry with repository",
+			input:    "username/repo",
+			expected: Registry{Host: "docker.io", Repository: "username/repo"},
 		},
 		{
 			name:     "ghcr registry",
 			input:    "ghcr.io/username",
-			expected: "ghcr.io",
+			expected: Registry{Host: "ghcr.io", Repository: "username"},
+		},
+		{
+			name:     "ghcr registry nested",
+			input:    "ghcr.io/org/team/app",
+			expected: Registry{Host: "ghcr.io", Repository: "org/team/app"},
+		},
+		{
+			name:     "artifact registry",
+			input:    "us-docker.pkg.dev/project/repo/img",
+			expected: Registry{Host: "us-docker.pkg.dev", Repository: "project/repo/img"},
+		},
+		{
+			name:     "localhost with port",
+			input:    "localhost:5000/a/b",
+			expected: Registry{Host: "localhost", Port: "5000", Repository: "a/b"},
+		},
+		{
+			name:     "localhost without port",
+			input:    "localhost/app",
+			expected: Registry{Host: "localhost", Repository: "app"},
 		},
 		{
-			name:     "any registry",
+			name:     "host with port",
+			input:    "registry.example.com:8443/app",
+			expected: Registry{Host: "registry.example.com", Port: "8443", Repository: "app"},
+		},
+		{
+			name:     "docker username is not a registry",
 			input:    "any/username",
-			expected: "any",
+			expected: Registry{Host: "docker.io", Repository: "any/username"},
 		},
 		{
 			name:     "any registry with space",
-			input:    " any/username ",
-			expected: "any",
+			input:    " any.io/username ",
+			expected: Registry{Host: "any.io", Repository: "username"},
 		},
 		{
-			name:  "invalid registry",
-			input: "too/many/names",
+			name:  "invalid uppercase repository",
+			input: "ghcr.io/UserName",
+			err:   errorInvalidRegistry,
+		},
+		{
+			name:  "invalid registry with tag",
+			input: "ghcr.io/username:latest",
+			err:   errorInvalidRegistry,
+		},
+		{
+			name:  "invalid ko local",
+			input: "ko.local",
+			err:   errorInvalidRegistry,
+		},
+		{
+			name:  "invalid kind local",
+			input: "kind.local/username",
 			err:   errorInvalidRegistry,
 		},
 	}
@@ -374,10 +926,184 @@ func Test_generateRegistry(t *testing.T) {
 			if err != nil {
 				return
 			}
-			expectedRegistry := tt.expected
-			if expectedRegistry != registry {
-				t.Errorf(cmp.Diff(expectedRegistry, registry))
+			if !cmp.Equal(*registry, tt.expected) {
+				t.Errorf(cmp.Diff(*registry, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_Registry_Address(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		registry Registry
+		expected string
+	}{
+		{registry: Registry{Host: "ghcr.io"}, expected: "ghcr.io"},
+		{registry: Registry{Host: "localhost", Port: "5000"}, expected: "localhost:5000"},
+		{registry: Registry{Host: "::1", Port: "5000"}, expected: "[::1]:5000"},
+	}
+
+	for _, tt := range tests {
+		if a := tt.registry.Address(); a != tt.expected {
+			t.Errorf(cmp.Diff(a, tt.expected))
+		}
+	}
+}
+
+func Test_SetEnvPolicy(t *testing.T) {
+	t.Parallel()
+
+	b := KoBuildNew("ko")
+	b.SetEnvPolicy(EnvPolicy{
+		Allow: []string{"KO_DOCKER_REPO", "MY_*"},
+		Deny:  []string{"MY_SECRET"},
+	})
+
+	if err := b.SetArgEnvVariables("KO_DOCKER_REPO=ghcr.io/org,MY_VAR=1"); err != nil {
+		t.Fatalf("SetArgEnvVariables: %v", err)
+	}
+	for _, env := range []string{"GOOS=linux", "KO_DEFAULTBASEIMAGE=alpine", "MY_SECRET=1"} {
+		if err := b.SetArgEnvVariables(env); !errCmp(err, errorEnvVariableNameNotAllowed) {
+			t.Errorf("%s: %v", env, cmp.Diff(err, errorEnvVariableNameNotAllowed))
+		}
+	}
+}
+
+func Test_SetDate(t *testing.T) {
+	t.Parallel()
+
+	// The date is pinned once, so that all the templates
+	// of a build are expanded with the same date.
+	b := KoBuildNew("ko")
+	date := b.buildDate()
+	if d := b.buildDate(); !d.Equal(date) {
+		t.Errorf(cmp.Diff(d, date))
+	}
+
+	// The dry run's date is reused by the build.
+	if err := b.SetDate("2022-04-12T21:12:40+02:00"); err != nil {
+		t.Fatalf("SetDate: %v", err)
+	}
+	expected := time.Date(2022, 4, 12, 19, 12, 40, 0, time.UTC)
+	if d := b.buildDate(); d != expected {
+		t.Errorf(cmp.Diff(d, expected))
+	}
+
+	if err := b.SetDate("2022-04-12"); !errCmp(err, errorInvalidTemplate) {
+		t.Errorf(cmp.Diff(err, errorInvalidTemplate))
+	}
+}
+
+func Test_SetArgEnvVariablesList(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		argEnv string
+	}{
+		{
+			name:   "simple values",
+			argEnv: "GOOS=linux,GOARCH=arm64",
+		},
+		{
+			name:   "values with equal and comma",
+			argEnv: `GOFLAGS="-ldflags=-X=main.v=1 -tags=a,b",KO_DEFAULTBASEIMAGE=gcr.io/x@sha256:abc`,
+		},
+		{
+			name:   "values with quotes and spaces",
+			argEnv: `GOVAR1=' "a" ',GOVAR2=`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			b := KoBuildNew("ko")
+			if err := b.SetArgEnvVariables(tt.argEnv); err != nil {
+				t.Fatalf("SetArgEnvVariables: %v", err)
+			}
+
+			// Round-trip through the encoding of the dry run output.
+			env, err := b.generateCommandEnvVariables()
+			if err != nil {
+				t.Fatalf("generateCommandEnvVariables: %v", err)
+			}
+			encoded, err := marshallList(env)
+			if err != nil {
+				t.Fatalf("marshallList: %v", err)
+			}
+
+			rb := KoBuildNew("ko")
+			if err := rb.SetArgEnvVariablesList(encoded); err != nil {
+				t.Fatalf("SetArgEnvVariablesList: %v", err)
+			}
+			if !cmp.Equal(rb.envs, b.envs) {
+				t.Errorf(cmp.Diff(rb.envs, b.envs))
+			}
+
+			renv, err := rb.generateCommandEnvVariables()
+			if err != nil {
+				t.Fatalf("generateCommandEnvVariables: %v", err)
+			}
+			sorted := cmpopts.SortSlices(func(a, b string) bool { return a < b })
+			if !cmp.Equal(renv, env, sorted) {
+				t.Errorf(cmp.Diff(renv, env, sorted))
 			}
 		})
 	}
+
+	b := KoBuildNew("ko")
+	encoded, err := marshallList([]string{"GOOS=linux", "LD_PRELOAD=/tmp/lib.so"})
+	if err != nil {
+		t.Fatalf("marshallList: %v", err)
+	}
+	if err := b.SetArgEnvVariablesList(encoded); !errCmp(err, errorEnvVariableNameNotAllowed) {
+		t.Errorf(cmp.Diff(err, errorEnvVariableNameNotAllowed))
+	}
+	if len(b.envs) != 0 {
+		t.Errorf("rejected env variables were recorded: %v", b.envs)
+	}
+}
+
+func Test_generateCommandEnvVariables_ordering(t *testing.T) {
+	t.Parallel()
+
+	envs := "KO_DOCKER_REPO=ghcr.io/org,GOOS=linux,CGO_ENABLED=0,GOARCH=arm64,GOFLAGS=-trimpath,GOAMD64=v3,KO_DEFAULTBASEIMAGE=alpine"
+	expected := []string{
+		"CGO_ENABLED=0", "GOAMD64=v3", "GOARCH=arm64", "GOFLAGS=-trimpath", "GOOS=linux",
+		"KO_DEFAULTBASEIMAGE=alpine", "KO_DOCKER_REPO=ghcr.io/org",
+	}
+	expectedEncoded, err := marshallList(expected)
+	if err != nil {
+		t.Fatalf("marshallList: %v", err)
+	}
+
+	// Map iteration order is randomized, so repeat to catch
+	// any dependency on it.
+	for i := 0; i < 50; i++ {
+		b := KoBuildNew("ko")
+		if err := b.SetArgEnvVariables(envs); err != nil {
+			t.Fatalf("SetArgEnvVariables: %v", err)
+		}
+
+		env, err := b.generateCommandEnvVariables()
+		if err != nil {
+			t.Fatalf("generateCommandEnvVariables: %v", err)
+		}
+		if !cmp.Equal(env, expected) {
+			t.Fatalf(cmp.Diff(env, expected))
+		}
+
+		encoded, err := marshallList(env)
+		if err != nil {
+			t.Fatalf("marshallList: %v", err)
+		}
+		if encoded != expectedEncoded {
+			t.Fatalf(cmp.Diff(encoded, expectedEncoded))
+		}
+	}
 }
@@ -0,0 +1,134 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var errorBuilderInfo = errors.New("cannot identify the builder")
+
+// BuilderInfo identifies the exact release of the builder
+// that generates the provenance, so that verifiers can pin it.
+type BuilderInfo struct {
+	// ID is the ref of the builder's reusable workflow,
+	// as in the job_workflow_ref claim.
+	ID string
+	// Digest is the sha256 digest of the builder's executable.
+	Digest string
+	// KoVersion is the version of ko the images are built with.
+	// It is unknown if empty.
+	KoVersion string
+	// RunnerOS and RunnerArch are the os and architecture of the
+	// GitHub Actions runner, e.g., Linux and X64. They are unknown
+	// if empty.
+	RunnerOS   string
+	RunnerArch string
+}
+
+// url returns the builder ID as it appears in the provenance.
+func (b BuilderInfo) url() string {
+	return builderURL(b.ID)
+}
+
+// version returns the ref of the builder's reusable workflow,
+// e.g., refs/tags/v1.0.0.
+func (b BuilderInfo) version() string {
+	if i := strings.LastIndex(b.ID, "@"); i >= 0 {
+		return b.ID[i+1:]
+	}
+	return ""
+}
+
+// koPURL returns the package URL of the ko release.
+// See https://github.com/package-url/purl-spec.
+func (b BuilderInfo) koPURL() string {
+	version := b.KoVersion
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	return "pkg:golang/github.com/google/ko@" + version
+}
+
+// newBuilderInfo identifies the running builder, whose reusable workflow
+// is builderID, and the version of ko if its path is not empty.
+func newBuilderInfo(builderID, ko string) (BuilderInfo, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return BuilderInfo{}, fmt.Errorf("%w: %v", errorBuilderInfo, err)
+	}
+	digest, err := fileDigest(executable)
+	if err != nil {
+		return BuilderInfo{}, fmt.Errorf("%w: %v", errorBuilderInfo, err)
+	}
+
+	info := BuilderInfo{
+		ID:         builderID,
+		Digest:     digest,
+		RunnerOS:   os.Getenv("RUNNER_OS"),
+		RunnerArch: os.Getenv("RUNNER_ARCH"),
+	}
+	if ko != "" {
+		info.KoVersion, err = koVersion(ko)
+		if err != nil {
+			return BuilderInfo{}, err
+		}
+	}
+	return info, nil
+}
+
+// fileDigest returns the hex-encoded sha256 digest of the file.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// koVersion returns the version ko reports.
+func koVersion(ko string) (string, error) {
+	out, err := exec.Command(ko, "version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s version: %v", errorKoFailed, ko, err)
+	}
+	version := strings.TrimSpace(string(out))
+	if err := validateKoVersion(version); err != nil {
+		return "", fmt.Errorf("%w: %s version: %v", errorKoFailed, ko, err)
+	}
+	return version, nil
+}
+
+// validateKoVersion checks that the version of ko is a single word,
+// as ko reports it.
+func validateKoVersion(version string) error {
+	if version == "" || strings.ContainsAny(version, " \t\n") {
+		return fmt.Errorf("%w: unexpected ko version %q", errorBuilderInfo, version)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_newBuilderInfo(t *testing.T) {
+	t.Parallel()
+
+	// The builder is the test binary.
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+	digest, err := fileDigest(executable)
+	if err != nil {
+		t.Fatalf("fileDigest: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		ko       string
+		expected BuilderInfo
+		err      error
+	}{
+		{
+			name:     "without ko",
+			expected: BuilderInfo{ID: testJobWorkflowRef, Digest: digest},
+		},
+		{
+			name:     "with ko",
+			ko:       writeFakeKo(t, "", 0),
+			expected: BuilderInfo{ID: testJobWorkflowRef, Digest: digest, KoVersion: testKoVersion},
+		},
+		{
+			name: "ko not found",
+			ko:   filepath.Join(t.TempDir(), "ko"),
+			err:  errorKoFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			info, err := newBuilderInfo(testJobWorkflowRef, tt.ko)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(info, tt.expected) {
+				t.Errorf(cmp.Diff(info, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_BuilderInfo_version(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{id: testJobWorkflowRef, expected: "refs/tags/v1.0.0"},
+		{id: "org/builder/.github/workflows/builder.yml@main", expected: "main"},
+		{id: "org/builder/.github/workflows/builder.yml", expected: ""},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.id, func(t *testing.T) {
+			t.Parallel()
+
+			if v := (BuilderInfo{ID: tt.id}).version(); v != tt.expected {
+				t.Errorf(cmp.Diff(v, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_validateKoVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		version string
+		err     error
+	}{
+		{version: testKoVersion},
+		{version: "v0.11.2"},
+		{version: "", err: errorBuilderInfo},
+		{version: "0.11.2 injected", err: errorBuilderInfo},
+		{version: "0.11.2\n::set-output name=image::x", err: errorBuilderInfo},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.version, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateKoVersion(tt.version)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+		})
+	}
+}
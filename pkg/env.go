@@ -0,0 +1,314 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvPolicy restricts the env variables that callers may pass to ko.
+// An entry with a `*` matches all the names with the prefix before it
+// and the suffix after it, other entries match a name exactly. Deny takes precedence over Allow.
+type EnvPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+// DefaultEnvPolicy allows the variables that configure the Go toolchain
+// and ko, except those that change which tools are used.
+func DefaultEnvPolicy() EnvPolicy {
+	return EnvPolicy{
+		Allow: []string{"GO*", "CGO_*", "KO_*"},
+		Deny: []string{
+			// Dynamic loader and shell.
+			"LD_PRELOAD", "LD_LIBRARY_PATH", "PATH", "HOME",
+			// Go toolchain selection and configuration.
+			"GOENV", "GOROOT", "GOTOOLDIR", "GOTOOLCHAIN", "GOCACHEPROG",
+			// Build and module caches, which could be seeded with
+			// packages and modules that do not match the source.
+			"GOCACHE", "GOMODCACHE", "GOPATH",
+			// Checksum verification of the modules.
+			"GOSUMDB", "GONOSUMDB", "GOPRIVATE", "GOINSECURE",
+			// ko's go binary.
+			"KO_GO_PATH",
+			// cgo's allowlist of the compiler and linker flags
+			// of #cgo directives.
+			"CGO_*_ALLOW", "CGO_*_DISALLOW",
+		},
+	}
+}
+
+func (p *EnvPolicy) check(name, value string) error {
+	if name == "" {
+		return errorEnvVariableNameEmpty
+	}
+
+	if !envNameRegex.MatchString(name) {
+		return fmt.Errorf("%w: %s", errorInvalidEnvArgument, name)
+	}
+
+	if matchEnvPatterns(p.Deny, name) || !matchEnvPatterns(p.Allow, name) {
+		return fmt.Errorf("%w: %s", errorEnvVariableNameNotAllowed, name)
+	}
+
+	if name == "GOFLAGS" {
+		if err := checkGoFlags(value); err != nil {
+			return fmt.Errorf("%w: %s: %v", errorEnvVariableNameNotAllowed, name, err)
+		}
+	}
+
+	if isCgoFlagsVariable(name) {
+		if err := checkCgoFlags(value); err != nil {
+			return fmt.Errorf("%w: %s: %v", errorEnvVariableNameNotAllowed, name, err)
+		}
+	}
+
+	// The ko configuration is read from the repository,
+	// so that the builder records it.
+	if name == koConfigPathEnvKey {
+		if err := checkLocalPath(value); err != nil {
+			return fmt.Errorf("%w: %s: %v", errorEnvVariableNameNotAllowed, name, err)
+		}
+	}
+
+	return nil
+}
+
+func matchEnvPatterns(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if i := strings.Index(p, "*"); i >= 0 {
+			prefix, suffix := p[:i], p[i+1:]
+			if len(name) >= len(prefix)+len(suffix) &&
+				strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+				return true
+			}
+			continue
+		}
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+type envVariable struct {
+	name  string
+	value string
+}
+
+// envRune is a character of an env list, with whether
+// it was quoted or escaped.
+type envRune struct {
+	r      rune
+	quoted bool
+}
+
+// parseEnvList parses a comma-separated list of NAME=VALUE entries.
+// An entry is split on its first unquoted `=`, so values may contain `=`.
+// Commas, quotes and surrounding spaces are preserved in a value
+// when quoted with single or double quotes, or escaped with a backslash,
+// e.g., `GOFLAGS="-tags=a,b -trimpath",KO_DEFAULTBASEIMAGE=a\,b`.
+func parseEnvList(s string) ([]envVariable, error) {
+	var (
+		entries [][]envRune
+		current []envRune
+	)
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch c {
+		case ',':
+			entries = append(entries, current)
+			current = nil
+
+		case '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("%w: trailing backslash: %s", errorInvalidEnvArgument, s)
+			}
+			i++
+			current = append(current, envRune{r: runes[i], quoted: true})
+
+		case '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated single quote: %s", errorInvalidEnvArgument, s)
+			}
+			for _, r := range runes[i+1 : end] {
+				current = append(current, envRune{r: r, quoted: true})
+			}
+			i = end
+
+		case '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) &&
+					(runes[i+1] == '"' || runes[i+1] == '\\') {
+					i++
+				}
+				current = append(current, envRune{r: runes[i], quoted: true})
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("%w: unterminated double quote: %s", errorInvalidEnvArgument, s)
+			}
+
+		default:
+			current = append(current, envRune{r: c})
+		}
+	}
+	entries = append(entries, current)
+
+	res := make([]envVariable, 0, len(entries))
+	for _, e := range entries {
+		j := -1
+		for k, r := range e {
+			if r.r == '=' && !r.quoted {
+				j = k
+				break
+			}
+		}
+		if j < 0 {
+			return nil, fmt.Errorf("%w: %s", errorInvalidEnvArgument, envRunesString(e))
+		}
+		res = append(res, envVariable{
+			name:  envRunesString(trimEnvRunes(e[:j])),
+			value: envRunesString(trimEnvRunes(e[j+1:])),
+		})
+	}
+
+	return res, nil
+}
+
+// trimEnvRunes removes the unquoted leading and trailing spaces.
+func trimEnvRunes(e []envRune) []envRune {
+	for len(e) > 0 && e[0].r == ' ' && !e[0].quoted {
+		e = e[1:]
+	}
+	for len(e) > 0 && e[len(e)-1].r == ' ' && !e[len(e)-1].quoted {
+		e = e[:len(e)-1]
+	}
+	return e
+}
+
+func envRunesString(e []envRune) string {
+	var sb strings.Builder
+	for _, r := range e {
+		sb.WriteRune(r.r)
+	}
+	return sb.String()
+}
+
+// deniedGoFlags are the go command flags that run arbitrary
+// programs or substitute files during the build.
+var deniedGoFlags = []string{"-toolexec", "-exec", "-overlay", "-modfile"}
+
+// deniedLinkerFlags are the flags of the Go linker, passed with
+// -ldflags, that select the external linker or archiver, or pass
+// flags to the external linker.
+var deniedLinkerFlags = []string{"-extld", "-extldflags", "-extar"}
+
+// deniedCgoFlags are the prefixes of the C compiler and linker flags
+// that run other programs, or read flags or plugins from files.
+var deniedCgoFlags = []string{
+	"-B", "-wrapper", "-fplugin", "-specs", "--specs",
+	"-fuse-ld", "--ld-path", "-Wl,-plugin", "-Wl,--plugin", "@",
+}
+
+func checkGoFlags(value string) error {
+	fields := strings.Fields(value)
+	for i, f := range fields {
+		sp := strings.SplitN(f, "=", 2)
+		// The go command accepts both -flag and --flag.
+		name := "-" + strings.TrimLeft(sp[0], "-")
+		for _, d := range deniedGoFlags {
+			if name == d {
+				return fmt.Errorf("flag %s is not allowed", d)
+			}
+		}
+
+		// -mod=mod updates go.mod and go.sum instead of
+		// verifying the modules against them.
+		if name == "-mod" {
+			mode := ""
+			switch {
+			case len(sp) == 2:
+				mode = sp[1]
+			case i+1 < len(fields):
+				mode = fields[i+1]
+			}
+			if mode == "mod" {
+				return fmt.Errorf("flag -mod=mod is not allowed")
+			}
+		}
+
+		if name != "-ldflags" {
+			continue
+		}
+		// The value follows the = or is the next argument.
+		ldflags := ""
+		switch {
+		case len(sp) == 2:
+			ldflags = sp[1]
+		case i+1 < len(fields):
+			ldflags = fields[i+1]
+		}
+		if err := checkLinkerFlags(ldflags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLinkerFlags checks the flags passed to the Go linker,
+// as the value of -ldflags or the ldflags of the ko configuration.
+func checkLinkerFlags(value string) error {
+	for _, f := range strings.Fields(value) {
+		// The flags may be prefixed with a package pattern, e.g., all=-s,
+		// and a flag may be the value of another, e.g., -X main.v=-extld.
+		if i := strings.Index(f, "=-"); i >= 0 {
+			if err := checkLinkerFlags(f[i+1:]); err != nil {
+				return err
+			}
+		}
+		name := "-" + strings.TrimLeft(strings.SplitN(f, "=", 2)[0], "-")
+		for _, d := range deniedLinkerFlags {
+			if name == d {
+				return fmt.Errorf("linker flag %s is not allowed", d)
+			}
+		}
+	}
+	return nil
+}
+
+// isCgoFlagsVariable reports whether the env variable holds the flags
+// cgo passes to the C compiler or linker, e.g., CGO_LDFLAGS.
+func isCgoFlagsVariable(name string) bool {
+	return strings.HasPrefix(name, "CGO_") && strings.HasSuffix(name, "FLAGS")
+}
+
+func checkCgoFlags(value string) error {
+	for _, f := range strings.Fields(value) {
+		for _, d := range deniedCgoFlags {
+			if strings.HasPrefix(f, d) {
+				return fmt.Errorf("flag %s is not allowed", f)
+			}
+		}
+	}
+	return nil
+}
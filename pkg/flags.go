@@ -0,0 +1,153 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type flagClass int
+
+const (
+	// flagAllowed is a boolean flag, passed as `--flag` or `--flag=bool`.
+	flagAllowed flagClass = iota
+	// flagRequiresValue is a flag passed as `--flag=value` or `--flag value`.
+	flagRequiresValue
+	// flagForbidden is a flag that defeats provenance generation,
+	// e.g., because the image is not pushed or is not named as
+	// the builder expects.
+	flagForbidden
+)
+
+type flagRule struct {
+	class flagClass
+	// validate optionally restricts the values a flag accepts.
+	validate func(value string) error
+}
+
+// flagPolicy maps the flag names, including their leading dashes,
+// to the rules that apply to them.
+type flagPolicy map[string]flagRule
+
+// koPublishFlagPolicy lists the flags of `ko publish` the builder knows about.
+// Flags that are not listed are rejected.
+// See https://github.com/google/ko/blob/main/docs/reference/ko_publish.md.
+var koPublishFlagPolicy = flagPolicy{
+	"--tags":                  {class: flagRequiresValue},
+	"-t":                      {class: flagRequiresValue},
+	"--platform":              {class: flagRequiresValue, validate: validatePlatforms},
+	"--image-label":           {class: flagRequiresValue},
+	"--sbom":                  {class: flagRequiresValue},
+	"--jobs":                  {class: flagRequiresValue},
+	"-j":                      {class: flagRequiresValue},
+	"--disable-optimizations": {class: flagAllowed},
+	"--push":                  {class: flagAllowed, validate: mustBeTrue},
+	"--local":                 {class: flagForbidden},
+	"-L":                      {class: flagForbidden},
+	"--tarball":               {class: flagForbidden},
+	"--oci-layout-path":       {class: flagForbidden},
+	"--image-refs":            {class: flagForbidden},
+	"--insecure-registry":     {class: flagForbidden},
+	"--tag-only":              {class: flagForbidden},
+	"--bare":                  {class: flagForbidden},
+	"--base-import-paths":     {class: flagForbidden},
+	"-B":                      {class: flagForbidden},
+	"--preserve-import-paths": {class: flagForbidden},
+	"-P":                      {class: flagForbidden},
+}
+
+// koFlag is a flag parsed from the arguments.
+type koFlag struct {
+	name  string
+	value string
+}
+
+// koArgs holds the parsed arguments of `ko publish`.
+type koArgs struct {
+	flags       []koFlag
+	importPaths []string
+}
+
+// parse parses and validates the arguments against the policy.
+// Arguments not starting with a dash, and all arguments after `--`,
+// are import paths.
+func (p flagPolicy) parse(args []string) (*koArgs, error) {
+	res := &koArgs{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			res.importPaths = append(res.importPaths, args[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			res.importPaths = append(res.importPaths, arg)
+			continue
+		}
+
+		name, value, hasValue := arg, "", false
+		if j := strings.Index(arg, "="); j >= 0 {
+			name, value, hasValue = arg[:j], arg[j+1:], true
+		}
+
+		rule, ok := p[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown flag %s", errorUnsupportedArguments, name)
+		}
+
+		switch rule.class {
+		case flagForbidden:
+			return nil, fmt.Errorf("%w: %s", errorUnsupportedArguments, name)
+
+		case flagAllowed:
+			if !hasValue {
+				value = "true"
+			}
+			if _, err := strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("%w: %s expects a boolean: %s", errorInvalidArgument, name, value)
+			}
+
+		case flagRequiresValue:
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("%w: %s requires a value", errorInvalidArgument, name)
+				}
+				i++
+				value = args[i]
+			}
+		}
+
+		if rule.validate != nil {
+			if err := rule.validate(value); err != nil {
+				return nil, fmt.Errorf("%w: %s=%s: %v", errorUnsupportedArguments, name, value, err)
+			}
+		}
+
+		res.flags = append(res.flags, koFlag{name: name, value: value})
+	}
+
+	return res, nil
+}
+
+func mustBeTrue(value string) error {
+	if v, err := strconv.ParseBool(value); err != nil || !v {
+		return fmt.Errorf("only true is supported")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_flagPolicy_parse(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected *koArgs
+		err      error
+	}{
+		{
+			name: "import paths only",
+			args: []string{"./cmd/a", "github.com/org/repo/cmd/b"},
+			expected: &koArgs{
+				importPaths: []string{"./cmd/a", "github.com/org/repo/cmd/b"},
+			},
+		},
+		{
+			name: "value flags",
+			args: []string{"--tags=v1,latest", "-t", "v2", "--platform", "linux/amd64", "./cmd"},
+			expected: &koArgs{
+				flags: []koFlag{
+					{name: "--tags", value: "v1,latest"},
+					{name: "-t", value: "v2"},
+					{name: "--platform", value: "linux/amd64"},
+				},
+				importPaths: []string{"./cmd"},
+			},
+		},
+		{
+			name: "value starting with dash",
+			args: []string{"--image-label", "-x"},
+			expected: &koArgs{
+				flags: []koFlag{{name: "--image-label", value: "-x"}},
+			},
+		},
+		{
+			name: "boolean flags",
+			args: []string{"--disable-optimizations", "--push=true", "--disable-optimizations=false"},
+			expected: &koArgs{
+				flags: []koFlag{
+					{name: "--disable-optimizations", value: "true"},
+					{name: "--push", value: "true"},
+					{name: "--disable-optimizations", value: "false"},
+				},
+			},
+		},
+		{
+			name: "end of flags",
+			args: []string{"--push", "--", "--local"},
+			expected: &koArgs{
+				flags:       []koFlag{{name: "--push", value: "true"}},
+				importPaths: []string{"--local"},
+			},
+		},
+		{
+			name: "missing value",
+			args: []string{"./cmd", "--tags"},
+			err:  errorInvalidArgument,
+		},
+		{
+			name: "invalid boolean",
+			args: []string{"--disable-optimizations=maybe"},
+			err:  errorInvalidArgument,
+		},
+		{
+			name: "push false",
+			args: []string{"--push=false"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "local",
+			args: []string{"--local"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "local short",
+			args: []string{"-L"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "tarball",
+			args: []string{"--tarball=image.tar"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "oci layout",
+			args: []string{"--oci-layout-path", "dir"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "bare",
+			args: []string{"--bare"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "base import paths short",
+			args: []string{"-B", "./cmd"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "preserve import paths",
+			args: []string{"--preserve-import-paths"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "forbidden with false value",
+			args: []string{"--local=false"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "unknown flag",
+			args: []string{"-ldflags=-s"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "invalid platform",
+			args: []string{"--platform=linux"},
+			err:  errorUnsupportedArguments,
+		},
+		{
+			name: "combined short flag",
+			args: []string{"-tlatest"},
+			err:  errorUnsupportedArguments,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			res, err := koPublishFlagPolicy.parse(tt.args)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(res, tt.expected, cmp.AllowUnexported(koArgs{}, koFlag{})) {
+				t.Errorf(cmp.Diff(res, tt.expected, cmp.AllowUnexported(koArgs{}, koFlag{})))
+			}
+		})
+	}
+}
+
+func Test_SetArgs_policy(t *testing.T) {
+	t.Parallel()
+
+	b := KoBuildNew("ko")
+	if err := b.SetArgs("--tarball=image.tar ./cmd"); !errCmp(err, errorUnsupportedArguments) {
+		t.Errorf(cmp.Diff(err, errorUnsupportedArguments))
+	}
+	if len(b.args) != 0 {
+		t.Errorf("rejected arguments were recorded: %v", b.args)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+var errorFulcioFailed = errors.New("fulcio signing certificate request failed")
+
+// FulcioClient requests short-lived signing certificates.
+type FulcioClient interface {
+	// SigningCert returns the PEM-encoded certificate chain, leaf first,
+	// that binds the public key to the identity of the OIDC token.
+	// The proof is the signature of the token's subject by the key.
+	SigningCert(publicKey crypto.PublicKey, proof []byte, token string) ([]byte, error)
+}
+
+// fulcioHTTPClient is a client of the Fulcio v1 API.
+// See https://github.com/sigstore/fulcio/blob/main/openapi.yaml.
+type fulcioHTTPClient struct {
+	url    string
+	client *http.Client
+}
+
+// NewFulcioClient returns a client of the Fulcio instance at url,
+// or of the public instance if url is empty.
+func NewFulcioClient(url string) FulcioClient {
+	if url == "" {
+		url = defaultFulcioAddr
+	}
+	return &fulcioHTTPClient{
+		url:    strings.TrimSuffix(url, "/"),
+		client: http.DefaultClient,
+	}
+}
+
+// fulcioCertificateRequest is the body of a signingCert request.
+type fulcioCertificateRequest struct {
+	PublicKey struct {
+		Algorithm string `json:"algorithm"`
+		// Content is the DER-encoded public key.
+		Content []byte `json:"content"`
+	} `json:"publicKey"`
+	SignedEmailAddress []byte `json:"signedEmailAddress"`
+}
+
+func (c *fulcioHTTPClient) SigningCert(publicKey crypto.PublicKey,
+	proof []byte, token string) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorFulcioFailed, err)
+	}
+
+	var request fulcioCertificateRequest
+	request.PublicKey.Algorithm = "ecdsa"
+	request.PublicKey.Content = der
+	request.SignedEmailAddress = proof
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorFulcioFailed, err)
+	}
+
+	req, err := http.NewRequest("POST", c.url+"/api/v1/signingCert", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorFulcioFailed, err)
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/pem-certificate-chain")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorFulcioFailed, err)
+	}
+	defer resp.Body.Close()
+
+	chain, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorFulcioFailed, err)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s: %s", errorFulcioFailed, resp.Status, strings.TrimSpace(string(chain)))
+	}
+
+	return chain, nil
+}
+
+// KeylessSigner signs with an ephemeral key, certified by Fulcio
+// for the identity of an OIDC token.
+type KeylessSigner struct {
+	signature.SignerVerifier
+	chain []byte
+}
+
+// CertificateChain returns the PEM-encoded certificate chain
+// of the signing key, leaf first.
+func (s *KeylessSigner) CertificateChain() []byte {
+	return s.chain
+}
+
+// NewKeylessSigner generates an ephemeral ECDSA P-256 key and
+// obtains a certificate for it from Fulcio, authenticated by the token.
+func NewKeylessSigner(fulcio FulcioClient, token string) (*KeylessSigner, error) {
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := parseJWTClaims(token, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorFulcioFailed, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: the token has no subject", errorFulcioFailed)
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sv, err := signature.LoadECDSASignerVerifier(priv, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prove the possession of the key.
+	proof, err := sv.SignMessage(strings.NewReader(claims.Subject))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorSigningFailed, err)
+	}
+
+	chain, err := fulcio.SigningCert(priv.Public(), proof, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check that the leaf certifies the ephemeral key.
+	certs, err := cryptoutils.UnmarshalCertificatesFromPEM(chain)
+	if err != nil || len(certs) == 0 {
+		return nil, fmt.Errorf("%w: invalid certificate chain: %v", errorFulcioFailed, err)
+	}
+	if err := cryptoutils.EqualKeys(certs[0].PublicKey, priv.Public()); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorFulcioFailed, err)
+	}
+
+	return &KeylessSigner{SignerVerifier: sv, chain: chain}, nil
+}
+
+// NewGitHubKeylessSigner obtains a Fulcio certificate for the
+// identity of the GitHub workflow, whose token the provider issues.
+func NewGitHubKeylessSigner(fulcio FulcioClient, tokens TokenProvider) (*KeylessSigner, error) {
+	token, err := tokens.Token(defaultOIDCClientID)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeylessSigner(fulcio, token)
+}
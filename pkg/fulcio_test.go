@@ -0,0 +1,371 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	sigdsse "github.com/sigstore/sigstore/pkg/signature/dsse"
+)
+
+// testJWT returns an unsigned JWT token with the claims.
+func testJWT(t *testing.T, claims interface{}) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".c2ln"
+}
+
+// fakeFulcio is an in-process CA that issues certificates
+// the way Fulcio does for GitHub workflow tokens.
+type fakeFulcio struct {
+	root    *x509.Certificate
+	rootKey *ecdsa.PrivateKey
+}
+
+func newFakeFulcio(t *testing.T) *fakeFulcio {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake-fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return &fakeFulcio{root: root, rootKey: key}
+}
+
+func (f *fakeFulcio) SigningCert(publicKey crypto.PublicKey,
+	proof []byte, token string) ([]byte, error) {
+	var claims struct {
+		Subject        string `json:"sub"`
+		JobWorkflowRef string `json:"job_workflow_ref"`
+	}
+	if err := parseJWTClaims(token, &claims); err != nil {
+		return nil, err
+	}
+
+	verifier, err := signature.LoadVerifier(publicKey, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.VerifySignature(bytes.NewReader(proof),
+		strings.NewReader(claims.Subject)); err != nil {
+		return nil, fmt.Errorf("invalid proof of possession: %w", err)
+	}
+
+	uri, err := url.Parse("https://github.com/" + claims.JobWorkflowRef)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(10 * time.Minute),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		URIs:         []*url.URL{uri},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidFulcioIssuer, Value: []byte(defaultGitHubIssuer)},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.root, publicKey, f.rootKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return cryptoutils.MarshalCertificatesToPEM([]*x509.Certificate{leaf, f.root})
+}
+
+// fulcioFunc adapts a function to the FulcioClient interface.
+type fulcioFunc func(publicKey crypto.PublicKey, proof []byte, token string) ([]byte, error)
+
+func (f fulcioFunc) SigningCert(publicKey crypto.PublicKey, proof []byte, token string) ([]byte, error) {
+	return f(publicKey, proof, token)
+}
+
+func Test_NewKeylessSigner(t *testing.T) {
+	t.Parallel()
+
+	fulcio := newFakeFulcio(t)
+	token := testJWT(t, map[string]string{
+		"sub":              "repo:org/repo:ref:refs/tags/v1.2.3",
+		"job_workflow_ref": testJobWorkflowRef,
+	})
+
+	// A CA that certifies a key other than the requested one.
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	wrongKey := fulcioFunc(func(_ crypto.PublicKey, proof []byte, token string) ([]byte, error) {
+		sv, err := signature.LoadECDSASignerVerifier(other, crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		var claims struct {
+			Subject string `json:"sub"`
+		}
+		if err := parseJWTClaims(token, &claims); err != nil {
+			return nil, err
+		}
+		proof, err = sv.SignMessage(strings.NewReader(claims.Subject))
+		if err != nil {
+			return nil, err
+		}
+		return fulcio.SigningCert(other.Public(), proof, token)
+	})
+
+	tests := []struct {
+		name   string
+		fulcio FulcioClient
+		token  string
+		err    error
+	}{
+		{
+			name:   "certified key",
+			fulcio: fulcio,
+			token:  token,
+		},
+		{
+			name:   "certificate for another key",
+			fulcio: wrongKey,
+			token:  token,
+			err:    errorFulcioFailed,
+		},
+		{
+			name: "invalid certificate chain",
+			fulcio: fulcioFunc(func(crypto.PublicKey, []byte, string) ([]byte, error) {
+				return []byte("not a certificate"), nil
+			}),
+			token: token,
+			err:   errorFulcioFailed,
+		},
+		{
+			name:   "token without subject",
+			fulcio: fulcio,
+			token:  testJWT(t, map[string]string{"job_workflow_ref": testJobWorkflowRef}),
+			err:    errorFulcioFailed,
+		},
+		{
+			name:   "invalid token",
+			fulcio: fulcio,
+			token:  "token",
+			err:    errorFulcioFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			signer, err := NewKeylessSigner(tt.fulcio, tt.token)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+
+			certs, err := cryptoutils.UnmarshalCertificatesFromPEM(signer.CertificateChain())
+			if err != nil {
+				t.Fatalf("cryptoutils.UnmarshalCertificatesFromPEM: %v", err)
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(fulcio.root)
+			if _, err := certs[0].Verify(x509.VerifyOptions{
+				Roots:     roots,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+			}); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+			expected := "https://github.com/" + testJobWorkflowRef
+			if len(certs[0].URIs) != 1 || certs[0].URIs[0].String() != expected {
+				t.Errorf("unexpected identity: %v", certs[0].URIs)
+			}
+
+			// The envelope verifies with the certified key.
+			statement := []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`)
+			envelope, err := SignStatement(statement, signer)
+			if err != nil {
+				t.Fatalf("SignStatement: %v", err)
+			}
+			verifier, err := signature.LoadVerifier(certs[0].PublicKey, crypto.SHA256)
+			if err != nil {
+				t.Fatalf("signature.LoadVerifier: %v", err)
+			}
+			if err := sigdsse.WrapVerifier(verifier).VerifySignature(bytes.NewReader(envelope), nil); err != nil {
+				t.Errorf("VerifySignature: %v", err)
+			}
+		})
+	}
+}
+
+func Test_fulcioHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	fulcio := newFakeFulcio(t)
+	token := testJWT(t, map[string]string{
+		"sub":              "repo:org/repo:ref:refs/tags/v1.2.3",
+		"job_workflow_ref": testJobWorkflowRef,
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v1/signingCert" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var request fulcioCertificateRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(request.PublicKey.Content)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chain, err := fulcio.SigningCert(publicKey, request.SignedEmailAddress, token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(chain)
+	}))
+	t.Cleanup(s.Close)
+
+	tests := []struct {
+		name  string
+		url   string
+		token string
+		err   error
+	}{
+		{
+			name:  "signing certificate",
+			url:   s.URL,
+			token: token,
+		},
+		{
+			name:  "trailing slash",
+			url:   s.URL + "/",
+			token: token,
+		},
+		{
+			name:  "unauthorized",
+			url:   s.URL,
+			token: testJWT(t, map[string]string{"sub": "someone"}),
+			err:   errorFulcioFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			signer, err := NewKeylessSigner(NewFulcioClient(tt.url), tt.token)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			if len(signer.CertificateChain()) == 0 {
+				t.Errorf("expected a certificate chain")
+			}
+		})
+	}
+}
+
+func Test_generateAttestations_keyless(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	signer, err := NewKeylessSigner(newFakeFulcio(t), testJWT(t, map[string]string{
+		"sub":              "repo:org/repo:ref:refs/tags/v1.2.3",
+		"job_workflow_ref": testJobWorkflowRef,
+	}))
+	if err != nil {
+		t.Fatalf("NewKeylessSigner: %v", err)
+	}
+
+	images := []Image{
+		{Name: "ghcr.io/org/a", Digest: testDigest1},
+		{Name: "ghcr.io/org/b", Digest: testDigest2},
+	}
+	opts, err := AttestationOptions{Format: FormatStatement, Signer: signer}.normalize()
+	if err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	attestations, err := generateAttestations(images, gh, []string{"ko", "publish"}, nil, testBuilder, opts)
+	if err != nil {
+		t.Fatalf("generateAttestations: %v", err)
+	}
+	for _, att := range attestations {
+		if !bytes.Equal(att.Certificate, signer.CertificateChain()) {
+			t.Errorf("%s: missing certificate chain", att.Filename)
+		}
+	}
+}
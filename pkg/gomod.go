@@ -0,0 +1,142 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errorInvalidGoModule = errors.New("invalid Go module")
+
+// goModuleDigestAlgorithm is the name of the h1 hash of go.sum in digest
+// sets: the sha256 of the module's file hashes, as computed by
+// golang.org/x/mod/sumdb/dirhash.Hash1.
+// See https://github.com/in-toto/attestation/blob/main/spec/v1/digest_set.md.
+const goModuleDigestAlgorithm = "dirHash"
+
+// goModule is a dependency of the Go module the images are built from.
+type goModule struct {
+	Path    string
+	Version string
+	// Hash is the hex-encoded h1 hash of the module's content.
+	Hash string
+}
+
+// purl returns the package URL of the module. The namespace and name
+// of golang purls are lowercased, and their segments and the version are
+// percent-encoded, e.g., "+incompatible" as "%2Bincompatible".
+// See https://github.com/package-url/purl-spec.
+func (m goModule) purl() string {
+	segments := strings.Split(strings.ToLower(m.Path), "/")
+	for i, s := range segments {
+		segments[i] = purlEscape(s)
+	}
+	return fmt.Sprintf("pkg:golang/%s@%s", strings.Join(segments, "/"), purlEscape(m.Version))
+}
+
+// purlEscape percent-encodes the characters of s
+// that are not unreserved in URLs.
+func purlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// readGoModules returns the dependencies of the Go module in dir, as
+// listed in its go.sum. Only the modules whose content is hashed, i.e.,
+// that the go command downloaded to build the module, are returned:
+// the others only contributed their go.mod to version selection.
+// The go.sum is read as-is, without network access.
+func readGoModules(dir string) ([]goModule, error) {
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidGoModule, err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "go.sum"))
+	if errors.Is(err, os.ErrNotExist) {
+		// The module has no dependency.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidGoModule, err)
+	}
+
+	var modules []goModule
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%w: go.sum:%d: malformed line", errorInvalidGoModule, n)
+		}
+		path, version, hash := fields[0], fields[1], fields[2]
+		if strings.HasSuffix(version, "/go.mod") {
+			continue
+		}
+
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "h1:"))
+		if !strings.HasPrefix(hash, "h1:") || err != nil || len(sum) != 32 {
+			return nil, fmt.Errorf("%w: go.sum:%d: unsupported hash %s", errorInvalidGoModule, n, hash)
+		}
+		key := path + "@" + version
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		modules = append(modules, goModule{Path: path, Version: version, Hash: hex.EncodeToString(sum)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidGoModule, err)
+	}
+	return modules, nil
+}
+
+// readModulePath returns the path of the Go module in dir,
+// as declared by the module directive of its go.mod.
+func readModulePath(dir string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errorInvalidGoModule, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], `"`), nil
+		}
+	}
+	return "", fmt.Errorf("%w: go.mod: no module directive", errorInvalidGoModule)
+}
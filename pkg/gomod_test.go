@@ -0,0 +1,157 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeGoModule writes a Go module with the go.mod and go.sum,
+// which is not written if nil.
+func writeGoModule(t *testing.T, goMod string, goSum *string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if goSum != nil {
+		if err := ioutil.WriteFile(filepath.Join(dir, "go.sum"), []byte(*goSum), 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return dir
+}
+
+func Test_readGoModules(t *testing.T) {
+	t.Parallel()
+
+	goMod := "module example.com/app\n\ngo 1.17\n"
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name     string
+		dir      string
+		expected []goModule
+		err      error
+	}{
+		{
+			name: "dependencies",
+			dir: writeGoModule(t, goMod, str(
+				"github.com/google/go-cmp v0.5.6/go.mod h1:v8dTdLbMG2kIc/vJvl+f65V22dbkXbowE6jgT/gNBxE=\n"+
+					"github.com/google/go-cmp v0.5.7 h1:81/ik6ipDQS2aGcBfIN5dHDB36BwrStyeAQquSYCV4o=\n"+
+					"github.com/google/go-cmp v0.5.7/go.mod h1:n+brtR0CgQNWTVd5ZUFpTBC8YFBDLK/h/bpaJ8/DtOE=\n"+
+					"\n"+
+					"golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 h1:E7g+9GITq07hpfrRu66IVDexMakfv52eLZ2CXBWiKr4=\n")),
+			expected: []goModule{
+				{
+					Path:    "github.com/google/go-cmp",
+					Version: "v0.5.7",
+					Hash:    "f35fe293a8a90d04b66867017c83797470c1dfa070ad2b7278042ab92602578a",
+				},
+				{
+					Path:    "golang.org/x/xerrors",
+					Version: "v0.0.0-20191204190536-9bdfabe68543",
+					Hash:    "13b83ef46213ab4ee1a5fad1bbae885437b131a91fbf9d9e2d9d825c15a22abe",
+				},
+			},
+		},
+		{
+			name: "no go.sum",
+			dir:  writeGoModule(t, goMod, nil),
+		},
+		{
+			name: "not a module",
+			dir:  t.TempDir(),
+			err:  errorInvalidGoModule,
+		},
+		{
+			name: "malformed line",
+			dir:  writeGoModule(t, goMod, str("github.com/google/go-cmp v0.5.7\n")),
+			err:  errorInvalidGoModule,
+		},
+		{
+			name: "unsupported hash",
+			dir:  writeGoModule(t, goMod, str("github.com/google/go-cmp v0.5.7 h2:81/ik6ipDQS2aGcBfIN5dHDB36BwrStyeAQquSYCV4o=\n")),
+			err:  errorInvalidGoModule,
+		},
+		{
+			name: "truncated hash",
+			dir:  writeGoModule(t, goMod, str("github.com/google/go-cmp v0.5.7 h1:81/ik6ipDQS2aGcB\n")),
+			err:  errorInvalidGoModule,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			modules, err := readGoModules(tt.dir)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if !cmp.Equal(modules, tt.expected) {
+				t.Errorf(cmp.Diff(modules, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_goModule_purl(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		module   goModule
+		expected string
+	}{
+		{
+			name:     "module",
+			module:   goModule{Path: "github.com/google/go-cmp", Version: "v0.5.7"},
+			expected: "pkg:golang/github.com/google/go-cmp@v0.5.7",
+		},
+		{
+			name:     "incompatible version",
+			module:   goModule{Path: "github.com/docker/docker", Version: "v20.10.12+incompatible"},
+			expected: "pkg:golang/github.com/docker/docker@v20.10.12%2Bincompatible",
+		},
+		{
+			name:     "upper-case path",
+			module:   goModule{Path: "github.com/Azure/go-autorest", Version: "v14.2.0+incompatible"},
+			expected: "pkg:golang/github.com/azure/go-autorest@v14.2.0%2Bincompatible",
+		},
+		{
+			name:     "pseudo-version",
+			module:   goModule{Path: "golang.org/x/sys", Version: "v0.0.0-20220209214540-3681064d5158"},
+			expected: "pkg:golang/golang.org/x/sys@v0.0.0-20220209214540-3681064d5158",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if purl := tt.module.purl(); purl != tt.expected {
+				t.Errorf(cmp.Diff(purl, tt.expected))
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var errorInvalidKoConfig = errors.New("invalid ko configuration")
+
+const (
+	// koConfigFilename is the name of ko's configuration file,
+	// which ko reads from its working directory.
+	koConfigFilename = ".ko.yaml"
+	// koConfigPathEnvKey selects another configuration file, or the
+	// directory of the .ko.yaml.
+	koConfigPathEnvKey = "KO_CONFIG_PATH"
+)
+
+type (
+	// KoConfig holds the settings of .ko.yaml. Settings the builder
+	// does not know about are rejected, so that all the settings that
+	// affect the images are recorded in the provenance.
+	// See https://github.com/google/ko/blob/main/docs/configuration.md.
+	KoConfig struct {
+		DefaultBaseImage   string            `json:"defaultBaseImage,omitempty"`
+		BaseImageOverrides map[string]string `json:"baseImageOverrides,omitempty"`
+		Builds             []KoBuildConfig   `json:"builds,omitempty"`
+	}
+	// KoBuildConfig configures the build of a main package.
+	KoBuildConfig struct {
+		ID      string      `json:"id,omitempty"`
+		Dir     string      `json:"dir,omitempty"`
+		Main    string      `json:"main,omitempty"`
+		Env     stringArray `json:"env,omitempty"`
+		Flags   stringArray `json:"flags,omitempty"`
+		Ldflags stringArray `json:"ldflags,omitempty"`
+	}
+
+	// KoConfigFile is the ko configuration file the build read,
+	// as recorded in the build config of the provenance.
+	KoConfigFile struct {
+		// Path is relative to ko's working directory.
+		Path   string            `json:"path"`
+		Digest map[string]string `json:"digest"`
+		// Config is the normalized content of the file.
+		Config KoConfig `json:"config"`
+		// ExpandedLdflags are the values of the templated ldflags
+		// ko was run with.
+		ExpandedLdflags []ExpandedLdflag `json:"expandedLdflags,omitempty"`
+	}
+	// ExpandedLdflag is an ldflag of a build expanded by the builder.
+	ExpandedLdflag struct {
+		// Build is the index of the build in the configuration.
+		Build    int    `json:"build"`
+		Template string `json:"template"`
+		Value    string `json:"value"`
+	}
+)
+
+// stringArray is a list of strings that may also be
+// written as a single string, as ko accepts.
+type stringArray []string
+
+func (a *stringArray) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = stringArray{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// loadKoConfig reads the configuration file ko uses when run in dir with
+// the env variables env: the .ko.yaml of dir, unless KO_CONFIG_PATH
+// selects another file or directory within dir. It returns nil if the
+// file does not exist, as ko then uses its defaults.
+func loadKoConfig(dir string, env []string) (*KoConfigFile, error) {
+	path := koConfigFilename
+	for _, e := range env {
+		if v := strings.TrimPrefix(e, koConfigPathEnvKey+"="); v != e {
+			if err := checkLocalPath(v); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", errorInvalidKoConfig, koConfigPathEnvKey, err)
+			}
+			path = v
+			if ext := filepath.Ext(v); ext != ".yaml" && ext != ".yml" {
+				path = filepath.Join(v, koConfigFilename)
+			}
+		}
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidKoConfig, err)
+	}
+
+	var config KoConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errorInvalidKoConfig, path, err)
+	}
+
+	digest := sha256.Sum256(content)
+	return &KoConfigFile{
+		Path: filepath.ToSlash(filepath.Clean(path)),
+		Digest: map[string]string{
+			"sha256": hex.EncodeToString(digest[:]),
+		},
+		Config: config,
+	}, nil
+}
+
+// validate checks the builds against the policies that apply to the
+// arguments and env variables callers pass to ko: their env variables
+// must satisfy the env policy, their go flags and ldflags must not be
+// denied, and their directories must be within ko's working directory.
+func (c *KoConfig) validate(policy EnvPolicy) error {
+	for i, build := range c.Builds {
+		if err := checkLocalPath(build.Dir); err != nil {
+			return fmt.Errorf("%w: builds[%d].dir: %v", errorInvalidKoConfig, i, err)
+		}
+		if err := checkLocalPath(build.Main); err != nil {
+			return fmt.Errorf("%w: builds[%d].main: %v", errorInvalidKoConfig, i, err)
+		}
+		for _, e := range build.Env {
+			sp := strings.SplitN(e, "=", 2)
+			if len(sp) != 2 {
+				return fmt.Errorf("%w: builds[%d].env: invalid entry %s", errorInvalidKoConfig, i, e)
+			}
+			if err := policy.check(sp[0], sp[1]); err != nil {
+				return fmt.Errorf("%w: builds[%d].env: %v", errorInvalidKoConfig, i, err)
+			}
+		}
+		if err := checkGoFlags(strings.Join(build.Flags, " ")); err != nil {
+			return fmt.Errorf("%w: builds[%d].flags: %v", errorInvalidKoConfig, i, err)
+		}
+		if err := checkLinkerFlags(strings.Join(build.Ldflags, " ")); err != nil {
+			return fmt.Errorf("%w: builds[%d].ldflags: %v", errorInvalidKoConfig, i, err)
+		}
+	}
+	return nil
+}
+
+// checkLocalPath checks that the path is empty or is a relative
+// path that does not escape its base directory.
+func checkLocalPath(path string) error {
+	if path == "" {
+		return nil
+	}
+	clean := filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(path) || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is not within the working directory", path)
+	}
+	return nil
+}
+
+// expandLdflags expands the templated ldflags of the builds with the
+// data, which is nil if unavailable, and records their values.
+func (f *KoConfigFile) expandLdflags(data *templateData) error {
+	f.ExpandedLdflags = nil
+	for i, build := range f.Config.Builds {
+		for _, ldflag := range build.Ldflags {
+			if !isTemplate(ldflag) {
+				continue
+			}
+			if data == nil {
+				return fmt.Errorf("%w: builds[%d].ldflags: templates require the GitHub context",
+					errorInvalidKoConfig, i)
+			}
+			value, err := data.expand(ldflag)
+			if err != nil {
+				return fmt.Errorf("%w: builds[%d].ldflags: %v", errorInvalidKoConfig, i, err)
+			}
+			// The values are checked as the ldflags are by validate.
+			if err := checkLinkerFlags(value); err != nil {
+				return fmt.Errorf("%w: builds[%d].ldflags: %v", errorInvalidKoConfig, i, err)
+			}
+			f.ExpandedLdflags = append(f.ExpandedLdflags, ExpandedLdflag{
+				Build:    i,
+				Template: ldflag,
+				Value:    value,
+			})
+		}
+	}
+	return nil
+}
+
+// marshal returns the base64-encoded JSON of the configuration file,
+// as shared by the `ko-config` output of the dry run.
+func (f *KoConfigFile) marshal() (string, error) {
+	jsonData, err := json.Marshal(f)
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(jsonData), nil
+}
+
+// ParseKoConfigFile parses the ko configuration file as output by the
+// dry run, with its expanded ldflags, and checks it against the default
+// policies of the builder.
+func ParseKoConfigFile(encoded string) (*KoConfigFile, error) {
+	jsonData, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidKoConfig, err)
+	}
+	var f KoConfigFile
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&f); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidKoConfig, err)
+	}
+
+	if err := checkLocalPath(f.Path); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidKoConfig, err)
+	}
+	if digest, err := hex.DecodeString(f.Digest["sha256"]); err != nil ||
+		len(digest) != sha256.Size || len(f.Digest) != 1 {
+		return nil, fmt.Errorf("%w: invalid digest %v", errorInvalidKoConfig, f.Digest)
+	}
+	if err := f.Config.validate(DefaultEnvPolicy()); err != nil {
+		return nil, err
+	}
+	for _, e := range f.ExpandedLdflags {
+		templated := false
+		if e.Build >= 0 && e.Build < len(f.Config.Builds) && isTemplate(e.Template) {
+			for _, ldflag := range f.Config.Builds[e.Build].Ldflags {
+				templated = templated || ldflag == e.Template
+			}
+		}
+		if !templated {
+			return nil, fmt.Errorf("%w: %q is not a templated ldflag of builds[%d]",
+				errorInvalidKoConfig, e.Template, e.Build)
+		}
+		if err := checkLinkerFlags(e.Value); err != nil {
+			return nil, fmt.Errorf("%w: builds[%d].ldflags: %v", errorInvalidKoConfig, e.Build, err)
+		}
+	}
+	return &f, nil
+}
+
+// writeExpanded writes the configuration, with its templated ldflags
+// replaced by their values, as the .ko.yaml of a temporary directory,
+// which is returned.
+func (f *KoConfigFile) writeExpanded() (string, error) {
+	config := f.Config
+	config.Builds = make([]KoBuildConfig, len(f.Config.Builds))
+	for i, build := range f.Config.Builds {
+		build.Ldflags = append(stringArray{}, build.Ldflags...)
+		for j, ldflag := range build.Ldflags {
+			for _, e := range f.ExpandedLdflags {
+				if e.Build == i && e.Template == ldflag {
+					build.Ldflags[j] = e.Value
+				}
+			}
+		}
+		config.Builds[i] = build
+	}
+
+	content, err := yaml.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errorInvalidKoConfig, err)
+	}
+	dir, err := os.MkdirTemp("", "ko-config-")
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errorInvalidKoConfig, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, koConfigFilename), content, 0o600); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("%w: %v", errorInvalidKoConfig, err)
+	}
+	return dir, nil
+}
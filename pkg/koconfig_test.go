@@ -0,0 +1,379 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeKoConfig writes the ko configuration file at path within dir.
+func writeKoConfig(t *testing.T, dir, path, content string) {
+	t.Helper()
+
+	path = filepath.Join(dir, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func Test_loadKoConfig(t *testing.T) {
+	t.Parallel()
+
+	content := `defaultBaseImage: gcr.io/distroless/base
+builds:
+- id: app
+  dir: ./app
+  main: ./cmd/app
+  env:
+  - CGO_ENABLED=0
+  flags: -trimpath
+  ldflags:
+  - -s -w
+  - -X main.version=v1.2.3
+`
+	sum := sha256.Sum256([]byte(content))
+	digest := map[string]string{"sha256": hex.EncodeToString(sum[:])}
+	config := KoConfig{
+		DefaultBaseImage: "gcr.io/distroless/base",
+		Builds: []KoBuildConfig{
+			{
+				ID:      "app",
+				Dir:     "./app",
+				Main:    "./cmd/app",
+				Env:     stringArray{"CGO_ENABLED=0"},
+				Flags:   stringArray{"-trimpath"},
+				Ldflags: stringArray{"-s -w", "-X main.version=v1.2.3"},
+			},
+		},
+	}
+
+	// withConfig returns a directory with the configuration file at path.
+	withConfig := func(path, content string) string {
+		dir := t.TempDir()
+		writeKoConfig(t, dir, path, content)
+		return dir
+	}
+
+	tests := []struct {
+		name     string
+		dir      string
+		env      []string
+		expected *KoConfigFile
+		err      error
+	}{
+		{
+			name:     "working directory",
+			dir:      withConfig(".ko.yaml", content),
+			env:      []string{"GOFLAGS=-trimpath"},
+			expected: &KoConfigFile{Path: ".ko.yaml", Digest: digest, Config: config},
+		},
+		{
+			name:     "KO_CONFIG_PATH directory",
+			dir:      withConfig("config/.ko.yaml", content),
+			env:      []string{"KO_CONFIG_PATH=./config"},
+			expected: &KoConfigFile{Path: "config/.ko.yaml", Digest: digest, Config: config},
+		},
+		{
+			name:     "KO_CONFIG_PATH file",
+			dir:      withConfig("config/ko.yml", content),
+			env:      []string{"KO_CONFIG_PATH=config/ko.yml"},
+			expected: &KoConfigFile{Path: "config/ko.yml", Digest: digest, Config: config},
+		},
+		{
+			name: "no configuration",
+			dir:  t.TempDir(),
+		},
+		{
+			name: "KO_CONFIG_PATH outside the working directory",
+			dir:  withConfig(".ko.yaml", content),
+			env:  []string{"KO_CONFIG_PATH=../config"},
+			err:  errorInvalidKoConfig,
+		},
+		{
+			name: "unknown setting",
+			dir:  withConfig(".ko.yaml", "defaultPlatforms: [linux/arm64]\n"),
+			err:  errorInvalidKoConfig,
+		},
+		{
+			name: "invalid yaml",
+			dir:  withConfig(".ko.yaml", "baseImageOverrides: [a, b]\n"),
+			err:  errorInvalidKoConfig,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			file, err := loadKoConfig(tt.dir, tt.env)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if !cmp.Equal(file, tt.expected) {
+				t.Errorf(cmp.Diff(file, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_KoConfig_validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		build KoBuildConfig
+		err   error
+	}{
+		{
+			name: "valid",
+			build: KoBuildConfig{
+				Dir:     "app",
+				Main:    "./cmd/app",
+				Env:     stringArray{"CGO_ENABLED=0", "GOFLAGS=-mod=vendor"},
+				Flags:   stringArray{"-trimpath", "-tags=netgo"},
+				Ldflags: stringArray{"-X main.version=v1.2.3"},
+			},
+		},
+		{
+			name:  "denied env variable",
+			build: KoBuildConfig{Env: stringArray{"LD_PRELOAD=/tmp/lib.so"}},
+			err:   errorInvalidKoConfig,
+		},
+		{
+			name:  "denied GOFLAGS",
+			build: KoBuildConfig{Env: stringArray{"GOFLAGS=-toolexec=/tmp/x"}},
+			err:   errorInvalidKoConfig,
+		},
+		{
+			name:  "malformed env variable",
+			build: KoBuildConfig{Env: stringArray{"CGO_ENABLED"}},
+			err:   errorInvalidKoConfig,
+		},
+		{
+			name:  "denied flag",
+			build: KoBuildConfig{Flags: stringArray{"-trimpath", "--overlay=/tmp/overlay.json"}},
+			err:   errorInvalidKoConfig,
+		},
+		{
+			name:  "denied ldflag",
+			build: KoBuildConfig{Ldflags: stringArray{"-s -w", "-extld=/tmp/ld"}},
+			err:   errorInvalidKoConfig,
+		},
+		{
+			name:  "denied ldflags in flags",
+			build: KoBuildConfig{Flags: stringArray{"-ldflags", "-extldflags=-B/tmp"}},
+			err:   errorInvalidKoConfig,
+		},
+		{
+			name:  "absolute dir",
+			build: KoBuildConfig{Dir: "/tmp/app"},
+			err:   errorInvalidKoConfig,
+		},
+		{
+			name:  "main outside the working directory",
+			build: KoBuildConfig{Main: "../other/cmd/app"},
+			err:   errorInvalidKoConfig,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := KoConfig{Builds: []KoBuildConfig{tt.build}}
+			err := config.validate(DefaultEnvPolicy())
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+		})
+	}
+}
+
+func Test_KoConfigFile_expandLdflags(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	data := newTemplateData(gh, time.Date(2022, 4, 12, 19, 12, 40, 0, time.UTC))
+
+	file, err := loadKoConfig(".", []string{"KO_CONFIG_PATH=testdata/koconfig/ldflags.yaml"})
+	if err != nil {
+		t.Fatalf("loadKoConfig: %v", err)
+	}
+
+	if err := file.expandLdflags(nil); !errCmp(err, errorInvalidKoConfig) {
+		t.Errorf(cmp.Diff(err, errorInvalidKoConfig))
+	}
+
+	if err := file.expandLdflags(&data); err != nil {
+		t.Fatalf("expandLdflags: %v", err)
+	}
+	expected := []ExpandedLdflag{
+		{
+			Build:    0,
+			Template: "-X main.version={{ .Git.Tag }} -X main.commit={{ .Git.ShortCommit }}",
+			Value:    "-X main.version=v1.2.3 -X main.commit=b54fb2e",
+		},
+		{
+			Build:    0,
+			Template: "-X main.ref={{ .Env.GITHUB_REF_NAME }}",
+			Value:    "-X main.ref=v1.2.3",
+		},
+	}
+	if !cmp.Equal(file.ExpandedLdflags, expected) {
+		t.Errorf(cmp.Diff(file.ExpandedLdflags, expected))
+	}
+
+	// ko reads the expanded values, the templates are kept.
+	dir, err := file.writeExpanded()
+	if err != nil {
+		t.Fatalf("writeExpanded: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	expanded, err := loadKoConfig(dir, nil)
+	if err != nil {
+		t.Fatalf("loadKoConfig: %v", err)
+	}
+	expectedLdflags := stringArray{"-s -w", expected[0].Value, expected[1].Value}
+	if ldflags := expanded.Config.Builds[0].Ldflags; !cmp.Equal(ldflags, expectedLdflags) {
+		t.Errorf(cmp.Diff(ldflags, expectedLdflags))
+	}
+	if ldflags := file.Config.Builds[0].Ldflags; ldflags[1] != expected[0].Template {
+		t.Errorf("unexpected ldflags: %v", ldflags)
+	}
+}
+
+func Test_ParseKoConfigFile(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	data := newTemplateData(gh, time.Date(2022, 4, 12, 19, 12, 40, 0, time.UTC))
+	file, err := loadKoConfig(".", []string{"KO_CONFIG_PATH=testdata/koconfig/ldflags.yaml"})
+	if err != nil {
+		t.Fatalf("loadKoConfig: %v", err)
+	}
+	if err := file.expandLdflags(&data); err != nil {
+		t.Fatalf("expandLdflags: %v", err)
+	}
+
+	// encode returns the output of the dry run for the file,
+	// modified by change.
+	encode := func(change func(f *KoConfigFile)) string {
+		f := *file
+		f.Config.Builds = append([]KoBuildConfig{}, file.Config.Builds...)
+		f.ExpandedLdflags = append([]ExpandedLdflag{}, file.ExpandedLdflags...)
+		change(&f)
+		encoded, err := f.marshal()
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		return encoded
+	}
+
+	tests := []struct {
+		name     string
+		encoded  string
+		expected *KoConfigFile
+		err      error
+	}{
+		{
+			name:     "dry run output",
+			encoded:  encode(func(f *KoConfigFile) {}),
+			expected: file,
+		},
+		{
+			name:    "not base64",
+			encoded: "{}",
+			err:     errorInvalidKoConfig,
+		},
+		{
+			name:    "unknown field",
+			encoded: base64.StdEncoding.EncodeToString([]byte(`{"path":".ko.yaml","extra":true}`)),
+			err:     errorInvalidKoConfig,
+		},
+		{
+			name:    "path outside the working directory",
+			encoded: encode(func(f *KoConfigFile) { f.Path = "../.ko.yaml" }),
+			err:     errorInvalidKoConfig,
+		},
+		{
+			name:    "invalid digest",
+			encoded: encode(func(f *KoConfigFile) { f.Digest = map[string]string{"sha256": "abc"} }),
+			err:     errorInvalidKoConfig,
+		},
+		{
+			name: "denied env",
+			encoded: encode(func(f *KoConfigFile) {
+				f.Config.Builds[0].Env = stringArray{"GOFLAGS=-toolexec=/bin/sh"}
+			}),
+			err: errorInvalidKoConfig,
+		},
+		{
+			name: "value of another ldflag",
+			encoded: encode(func(f *KoConfigFile) {
+				f.ExpandedLdflags[0].Template = "-s -w"
+			}),
+			err: errorInvalidKoConfig,
+		},
+		{
+			name: "value of another build",
+			encoded: encode(func(f *KoConfigFile) {
+				f.ExpandedLdflags[0].Build = 1
+			}),
+			err: errorInvalidKoConfig,
+		},
+		{
+			name: "denied expanded ldflag",
+			encoded: encode(func(f *KoConfigFile) {
+				f.ExpandedLdflags[0].Value = "-extld=/tmp/ld"
+			}),
+			err: errorInvalidKoConfig,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := ParseKoConfigFile(tt.encoded)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if !cmp.Equal(f, tt.expected) {
+				t.Errorf(cmp.Diff(f, tt.expected))
+			}
+		})
+	}
+}
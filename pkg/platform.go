@@ -0,0 +1,172 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// platformRegex matches the platforms ko accepts,
+// os/arch[/variant][:osversion], e.g., linux/arm/v7.
+var platformRegex = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9]+(/[a-z0-9]+)?(:[A-Za-z0-9.]+)?$`)
+
+// allPlatforms builds the images for all the platforms of the base image.
+const allPlatforms = "all"
+
+// ImageManifest is the manifest of an image for a platform,
+// within a multi-platform image index.
+type ImageManifest struct {
+	// Platform is the platform of the image, e.g., linux/arm64.
+	Platform string `json:"platform"`
+	// Digest is the hex-encoded sha256 digest of the manifest.
+	Digest string `json:"digest"`
+}
+
+// validatePlatforms validates the value of --platform,
+// a comma-separated list of platforms.
+func validatePlatforms(value string) error {
+	for _, p := range strings.Split(value, ",") {
+		if p != allPlatforms && !platformRegex.MatchString(p) {
+			return fmt.Errorf("invalid platform %q", p)
+		}
+	}
+	return nil
+}
+
+// requestedPlatforms returns the platforms requested by the ko
+// command com with --platform, in order. It returns nil if no platform
+// is requested, i.e., the images are built for ko's default platform.
+func requestedPlatforms(com []string) ([]string, error) {
+	if len(com) < 2 {
+		return nil, nil
+	}
+	args, err := koPublishFlagPolicy.parse(com[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	var platforms []string
+	seen := make(map[string]bool)
+	for _, f := range args.flags {
+		if f.name != "--platform" {
+			continue
+		}
+		for _, p := range strings.Split(f.value, ",") {
+			if !seen[p] {
+				seen[p] = true
+				platforms = append(platforms, p)
+			}
+		}
+	}
+	return platforms, nil
+}
+
+// resolveManifests returns the images with the manifests of each
+// platform, read from the registry, if the images are indexes. ko
+// publishes an index whenever it builds for several platforms, whether
+// they are selected by --platform, KO_DEFAULTPLATFORMS or the ko
+// configuration, so each image is read.
+func resolveManifests(images []Image, opts ...remote.Option) ([]Image, error) {
+	resolved := make([]Image, 0, len(images))
+	for _, image := range images {
+		ref, err := name.NewDigest(image.String())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", errorInvalidImage, image, err)
+		}
+		desc, err := remote.Get(ref, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", errorInvalidImage, image, err)
+		}
+
+		image.Manifests = nil
+		if desc.MediaType.IsIndex() {
+			index, err := desc.ImageIndex()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", errorInvalidImage, image, err)
+			}
+			manifest, err := index.IndexManifest()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", errorInvalidImage, image, err)
+			}
+			for _, m := range manifest.Manifests {
+				if m.Digest.Algorithm != "sha256" {
+					return nil, fmt.Errorf("%w: %s: %s", errorInvalidDigest, image, m.Digest)
+				}
+				var platform string
+				if m.Platform != nil {
+					platform = m.Platform.String()
+				}
+				image.Manifests = append(image.Manifests, ImageManifest{
+					Platform: platform,
+					Digest:   m.Digest.Hex,
+				})
+			}
+		}
+		resolved = append(resolved, image)
+	}
+	return resolved, nil
+}
+
+// koDefaultPlatformsEnvKey selects the platforms ko builds
+// for when --platform is not set.
+const koDefaultPlatformsEnvKey = "KO_DEFAULTPLATFORMS"
+
+// resolvePlatformManifests returns the images with their manifests, see
+// resolveManifests, if the ko command com, run with the env variables
+// env, builds for platforms selected by --platform or
+// KO_DEFAULTPLATFORMS. Otherwise ko publishes single-platform images
+// and the registry is not accessed, so that no credentials are needed.
+func resolvePlatformManifests(images []Image, com, env []string, opts ...remote.Option) ([]Image, error) {
+	platforms, err := requestedPlatforms(com)
+	if err != nil {
+		return nil, err
+	}
+	if len(platforms) == 0 {
+		for _, e := range env {
+			if v := strings.TrimPrefix(e, koDefaultPlatformsEnvKey+"="); v != e && v != "" {
+				platforms = append(platforms, v)
+			}
+		}
+	}
+	if len(platforms) == 0 {
+		return images, nil
+	}
+	return resolveManifests(images, opts...)
+}
+
+// builtPlatforms returns the platforms the images were built for: those
+// of the manifests of the indexes, in order, or the requested platforms
+// if no image is an index.
+func builtPlatforms(images []Image, requested []string) []string {
+	var platforms []string
+	seen := make(map[string]bool)
+	for _, image := range images {
+		for _, m := range image.Manifests {
+			if m.Platform != "" && !seen[m.Platform] {
+				seen[m.Platform] = true
+				platforms = append(platforms, m.Platform)
+			}
+		}
+	}
+	if len(platforms) == 0 {
+		return requested
+	}
+	return platforms
+}
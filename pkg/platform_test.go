@@ -0,0 +1,243 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// pushRandomIndex pushes an index of random images, one per platform,
+// to the repository. It returns the index and its manifests.
+func pushRandomIndex(t *testing.T, repository string, platforms ...v1.Platform) (Image, []ImageManifest) {
+	t.Helper()
+
+	var index v1.ImageIndex = empty.Index
+	var manifests []ImageManifest
+	for _, platform := range platforms {
+		platform := platform
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatalf("random.Image: %v", err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatalf("Digest: %v", err)
+		}
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &platform},
+		})
+		manifests = append(manifests, ImageManifest{Platform: platform.String(), Digest: digest.Hex})
+	}
+
+	ref, err := name.ParseReference(repository + ":latest")
+	if err != nil {
+		t.Fatalf("name.ParseReference: %v", err)
+	}
+	if err := remote.WriteIndex(ref, index); err != nil {
+		t.Fatalf("remote.WriteIndex: %v", err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	return Image{Name: repository, Digest: digest.Hex}, manifests
+}
+
+func Test_requestedPlatforms(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		com      []string
+		expected []string
+		err      error
+	}{
+		{
+			name: "default platform",
+			com:  []string{"ko", "publish", "./cmd/app"},
+		},
+		{
+			name:     "comma-separated platforms",
+			com:      []string{"ko", "publish", "--platform=linux/amd64,linux/arm64", "./cmd/app"},
+			expected: []string{"linux/amd64", "linux/arm64"},
+		},
+		{
+			name: "repeated flags",
+			com: []string{
+				"ko", "publish", "--platform", "linux/arm/v7",
+				"--platform=linux/amd64,linux/arm/v7", "./cmd/app",
+			},
+			expected: []string{"linux/arm/v7", "linux/amd64"},
+		},
+		{
+			name:     "all platforms",
+			com:      []string{"ko", "publish", "--platform=all", "./cmd/app"},
+			expected: []string{"all"},
+		},
+		{
+			name:     "os version",
+			com:      []string{"ko", "publish", "--platform=windows/amd64:10.0.17763.1879", "./cmd/app"},
+			expected: []string{"windows/amd64:10.0.17763.1879"},
+		},
+		{
+			name: "invalid platform",
+			com:  []string{"ko", "publish", "--platform=linux/amd64,arm64", "./cmd/app"},
+			err:  errorUnsupportedArguments,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			platforms, err := requestedPlatforms(tt.com)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if !cmp.Equal(platforms, tt.expected) {
+				t.Errorf(cmp.Diff(platforms, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_resolveManifests(t *testing.T) {
+	t.Parallel()
+
+	host := newTestRegistry(t)
+	single := pushRandomImage(t, host+"/app/single")
+	multi, manifests := pushRandomIndex(t, host+"/app/multi",
+		v1.Platform{OS: "linux", Architecture: "amd64"},
+		v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+	)
+	if manifests[1].Platform != "linux/arm/v7" {
+		t.Fatalf("unexpected platform: %s", manifests[1].Platform)
+	}
+
+	tests := []struct {
+		name     string
+		images   []Image
+		expected []Image
+		err      error
+	}{
+		{
+			name:     "image",
+			images:   []Image{single},
+			expected: []Image{single},
+		},
+		{
+			name:   "index",
+			images: []Image{multi, single},
+			expected: []Image{
+				{Name: multi.Name, Digest: multi.Digest, Manifests: manifests},
+				single,
+			},
+		},
+		{
+			name:   "missing image",
+			images: []Image{{Name: host + "/app/missing", Digest: single.Digest}},
+			err:    errorInvalidImage,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			images, err := resolveManifests(tt.images)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if !cmp.Equal(images, tt.expected) {
+				t.Errorf(cmp.Diff(images, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_resolvePlatformManifests(t *testing.T) {
+	t.Parallel()
+
+	host := newTestRegistry(t)
+	multi, manifests := pushRandomIndex(t, host+"/app/multi",
+		v1.Platform{OS: "linux", Architecture: "amd64"},
+		v1.Platform{OS: "linux", Architecture: "arm64"},
+	)
+	resolved := []Image{{Name: multi.Name, Digest: multi.Digest, Manifests: manifests}}
+	// missing is not in the registry, which is not accessed
+	// for single-platform builds.
+	missing := []Image{{Name: host + "/app/missing", Digest: multi.Digest}}
+
+	tests := []struct {
+		name     string
+		images   []Image
+		com      []string
+		env      []string
+		expected []Image
+		err      error
+	}{
+		{
+			name:     "default platform",
+			images:   missing,
+			com:      []string{"ko", "publish", "./cmd/app"},
+			expected: missing,
+		},
+		{
+			name:     "requested platforms",
+			images:   []Image{multi},
+			com:      []string{"ko", "publish", "--platform=linux/amd64,linux/arm64", "./cmd/app"},
+			expected: resolved,
+		},
+		{
+			name:     "default platforms",
+			images:   []Image{multi},
+			com:      []string{"ko", "publish", "./cmd/app"},
+			env:      []string{"KO_DEFAULTPLATFORMS=linux/amd64,linux/arm64"},
+			expected: resolved,
+		},
+		{
+			name:   "missing multi-platform image",
+			images: missing,
+			com:    []string{"ko", "publish", "--platform=all", "./cmd/app"},
+			err:    errorInvalidImage,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			images, err := resolvePlatformManifests(tt.images, tt.com, tt.env)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if !cmp.Equal(images, tt.expected) {
+				t.Errorf(cmp.Diff(images, tt.expected))
+			}
+		})
+	}
+}
@@ -16,11 +16,8 @@ package pkg
 
 import (
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"os"
 	"strings"
 
 	slsa "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v0.2"
@@ -39,6 +36,7 @@ type gitHubContext struct {
 	Repository   string      `json:"repository"`
 	ActionPath   string      `json:"action_path"`
 	Workflow     string      `json:"workflow"`
+	WorkflowRef  string      `json:"workflow_ref"`
 	EventName    string      `json:"event_name"`
 	EventPayload interface{} `json:"event"`
 	SHA          string      `json:"sha"`
@@ -75,6 +73,11 @@ type (
 	BuildConfig struct {
 		Version int    `json:"version"`
 		Steps   []Step `json:"steps"`
+		// KoConfig is the ko configuration file the steps read.
+		KoConfig *KoConfigFile `json:"koConfig,omitempty"`
+		// Platforms are the platforms the subjects are built for, as
+		// listed by their indexes, or requested for single images.
+		Platforms []string `json:"platforms,omitempty"`
 	}
 
 	Parameters struct {
@@ -90,19 +93,32 @@ type (
 	}
 )
 
+// buildType identifies that this is a slsa-framework's slsa-github-generator-ko' build.
+const buildType = "https://github.com/slsa-framework/slsa-github-generator-ko@v1"
+
 // GeneratePredicate translates github context into a SLSA predicate
 // attestation.
-// Spec: https://slsa.dev/provenance/v0.1
+// Spec: https://slsa.dev/provenance/v0.2
 func GeneratePredicate(name, digest, ghContext, command, envs string) ([]byte, error) {
-	gh := &gitHubContext{}
+	return generateSingle(name, digest, ghContext, command, envs, NewGitHubTokenProvider(), NewTokenVerifier(""), FormatPredicate)
+}
 
-	if err := json.Unmarshal([]byte(ghContext), gh); err != nil {
+// GenerateStatement translates github context into an in-toto statement
+// whose subject is the artifact and whose predicate is the SLSA provenance.
+// Spec: https://github.com/in-toto/attestation/blob/v0.1.0/spec/README.md#statement.
+func GenerateStatement(name, digest, ghContext, command, envs string) ([]byte, error) {
+	return generateSingle(name, digest, ghContext, command, envs, NewGitHubTokenProvider(), NewTokenVerifier(""), FormatStatement)
+}
+
+func generateSingle(name, digest, ghContext, command, envs string,
+	tokens TokenProvider, verifier *TokenVerifier, format AttestationFormat) ([]byte, error) {
+	if err := validateDigest(digest); err != nil {
 		return nil, err
 	}
-	gh.Token = ""
 
-	if _, err := hex.DecodeString(digest); err != nil || len(digest) != 64 {
-		return nil, fmt.Errorf("sha256 digest is not valid: %s", digest)
+	gh, err := parseGitHubContext(ghContext)
+	if err != nil {
+		return nil, err
 	}
 
 	com, err := unmarshallList(command)
@@ -115,19 +131,55 @@ func GeneratePredicate(name, digest, ghContext, command, envs string) ([]byte, e
 		return nil, err
 	}
 
-	builderID, err := getReusableWorkflowID()
+	builderID, err := getReusableWorkflowID(tokens, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	builder, err := newBuilderInfo(builderID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := generateProvenance(gh, com, env, builder, buildInputs{}, SLSAVersion02)
 	if err != nil {
 		return nil, err
 	}
+	return marshallAttestation([]Image{{Name: name, Digest: digest}}, p, format)
+}
+
+func parseGitHubContext(ghContext string) (*gitHubContext, error) {
+	gh := &gitHubContext{}
+
+	if err := json.Unmarshal([]byte(ghContext), gh); err != nil {
+		return nil, err
+	}
+	gh.Token = ""
 
-	predicate := slsa.ProvenancePredicate{
-		// Identifies that this is a slsa-framework's slsa-github-generator-ko' build.
-		BuildType: "https://github.com/slsa-framework/slsa-github-generator-ko@v1",
-		// Identifies the reusable workflow and matches the job_workflow_ref.
+	return gh, nil
+}
+
+func generatePredicate(gh *gitHubContext, com, env []string,
+	builder BuilderInfo, inputs buildInputs) *slsa.ProvenancePredicate {
+	materials := []slsa.ProvenanceMaterial{
+		{
+			URI: fmt.Sprintf("git+%s.git", gh.Repository),
+			Digest: slsa.DigestSet{
+				"sha1": gh.SHA,
+			},
+		},
+	}
+	materials = append(materials, moduleMaterials(inputs.modules)...)
+	materials = append(materials, baseImageMaterials(inputs.baseImages)...)
+	materials = append(materials, builderMaterials(builder)...)
+
+	return &slsa.ProvenancePredicate{
+		BuildType: buildType,
+		// Identifies the reusable workflow and matches the job_workflow_ref,
+		// which contains the builder's version. Its executable and ko are
+		// recorded as materials.
 		Builder: slsa.ProvenanceBuilder{
-			// TODO(https://github.com/slsa-framework/slsa-github-generator-go/issues/6): add
-			// version and hash.
-			ID: fmt.Sprintf("https://github.com/%s", builderID),
+			ID: builder.url(),
 		},
 		Invocation: slsa.ProvenanceInvocation{
 			ConfigSource: slsa.ConfigSource{
@@ -138,53 +190,108 @@ func GeneratePredicate(name, digest, ghContext, command, envs string) ([]byte, e
 				},
 			},
 			// Non user-controllable environment vars needed to reproduce the build.
-			Environment: map[string]interface{}{
-				"arch":               "amd64", // TODO: Does GitHub run actually expose this?
-				"os":                 "ubuntu",
-				"github_event_name":  gh.EventName,
-				"github_run_number":  gh.RunNumber,
-				"github_run_id":      gh.RunID,
-				"github_run_attempt": gh.RunAttempt,
-			},
+			Environment: generateEnvironment(gh, builder),
 			// Parameters coming from the trigger event.
-			Parameters: Parameters{
-				Version:      parametersVersion,
-				EventName:    gh.EventName,
-				Ref:          gh.Ref,
-				BaseRef:      gh.BaseRef,
-				HeadRef:      gh.HeadRef,
-				RefType:      gh.RefType,
-				Actor:        gh.Actor,
-				SHA1:         gh.SHA,
-				EventPayload: gh.EventPayload,
-			},
+			Parameters: generateParameters(gh),
 		},
-		BuildConfig: BuildConfig{
-			Version: buildConfigVersion,
-			Steps: []Step{
-				// Single step.
-				{
-					Command: com,
-					Env:     env,
-				},
+		BuildConfig: generateBuildConfig(com, env, inputs),
+		Materials:   materials,
+	}
+}
+
+// moduleMaterials returns the Go module dependencies.
+func moduleMaterials(modules []goModule) []slsa.ProvenanceMaterial {
+	var materials []slsa.ProvenanceMaterial
+	for _, m := range modules {
+		materials = append(materials, slsa.ProvenanceMaterial{
+			URI: m.purl(),
+			Digest: slsa.DigestSet{
+				goModuleDigestAlgorithm: m.Hash,
 			},
-		},
-		Materials: []slsa.ProvenanceMaterial{
-			{
-				URI: fmt.Sprintf("git+%s.git", gh.Repository),
-				Digest: slsa.DigestSet{
-					"sha1": gh.SHA,
-				},
+		})
+	}
+	return materials
+}
+
+// baseImageMaterials returns the base images of the invocation.
+func baseImageMaterials(images []baseImage) []slsa.ProvenanceMaterial {
+	var materials []slsa.ProvenanceMaterial
+	for _, image := range images {
+		materials = append(materials, slsa.ProvenanceMaterial{
+			URI: image.Name,
+			Digest: slsa.DigestSet{
+				"sha256": image.Digest,
 			},
-		},
+		})
 	}
+	return materials
+}
 
-	attBytes, err := json.Marshal(predicate)
-	if err != nil {
-		return nil, err
+// builderMaterials returns the builder's executable and
+// the ko release, if known.
+func builderMaterials(builder BuilderInfo) []slsa.ProvenanceMaterial {
+	var materials []slsa.ProvenanceMaterial
+	if builder.Digest != "" {
+		materials = append(materials, slsa.ProvenanceMaterial{
+			URI: builder.url(),
+			Digest: slsa.DigestSet{
+				"sha256": builder.Digest,
+			},
+		})
+	}
+	if builder.KoVersion != "" {
+		materials = append(materials, slsa.ProvenanceMaterial{
+			URI: builder.koPURL(),
+		})
 	}
+	return materials
+}
+
+// generateEnvironment returns the environment of the run. The arch and os
+// are those of the runner the builder runs on, not of the images.
+func generateEnvironment(gh *gitHubContext, builder BuilderInfo) map[string]interface{} {
+	env := map[string]interface{}{
+		"github_event_name":  gh.EventName,
+		"github_run_number":  gh.RunNumber,
+		"github_run_id":      gh.RunID,
+		"github_run_attempt": gh.RunAttempt,
+	}
+	if builder.RunnerArch != "" {
+		env["arch"] = builder.RunnerArch
+	}
+	if builder.RunnerOS != "" {
+		env["os"] = builder.RunnerOS
+	}
+	return env
+}
 
-	return attBytes, nil
+func generateParameters(gh *gitHubContext) Parameters {
+	return Parameters{
+		Version:      parametersVersion,
+		EventName:    gh.EventName,
+		Ref:          gh.Ref,
+		BaseRef:      gh.BaseRef,
+		HeadRef:      gh.HeadRef,
+		RefType:      gh.RefType,
+		Actor:        gh.Actor,
+		SHA1:         gh.SHA,
+		EventPayload: gh.EventPayload,
+	}
+}
+
+func generateBuildConfig(com, env []string, inputs buildInputs) BuildConfig {
+	return BuildConfig{
+		Version: buildConfigVersion,
+		Steps: []Step{
+			// Single step.
+			{
+				Command: com,
+				Env:     env,
+			},
+		},
+		KoConfig:  inputs.koConfig,
+		Platforms: inputs.platforms,
+	}
 }
 
 func unmarshallList(arg string) ([]string, error) {
@@ -207,61 +314,48 @@ func unmarshallList(arg string) ([]string, error) {
 }
 
 // Note: see https://github.com/sigstore/cosign/blob/739947de3d0197fbaab926bd9b896963ebf47a19/pkg/providers/github/github.go.
-func getReusableWorkflowID() (string, error) {
-	urlKey := os.Getenv(requestURLEnvKey)
-	if urlKey == "" {
-		return "", fmt.Errorf("requestURLEnvKey is empty")
-	}
-
-	url := urlKey + "&audience=" + audience
-	req, err := http.NewRequest("GET", url, nil)
+// The token is verified before its job_workflow_ref is trusted.
+func getReusableWorkflowID(tokens TokenProvider, verifier *TokenVerifier) (string, error) {
+	token, err := tokens.Token(audience)
 	if err != nil {
 		return "", err
 	}
 
-	req.Header.Add("Authorization", "bearer "+os.Getenv(requestTokenEnvKey))
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
+	// Extract fields from JSON payload.
+	var claims struct {
+		JobWorkflowRef string `json:"job_workflow_ref"`
 	}
-	defer resp.Body.Close()
 
-	var payload struct {
-		Value string `json:"value"`
+	if err := verifier.Verify(token, audience, &claims); err != nil {
+		return "", err
 	}
 
-	// Extract the value from JSON payload.
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&payload); err != nil {
-		return "", err
+	if claims.JobWorkflowRef == "" {
+		return "", fmt.Errorf("%w: job_workflow_ref is empty", errorInvalidToken)
 	}
 
+	return claims.JobWorkflowRef, nil
+}
+
+// parseJWTClaims decodes the claims of a JWT token into v.
+// The signature is not verified.
+func parseJWTClaims(token string, v interface{}) error {
 	// This is a JWT token with 3 parts.
-	parts := strings.Split(payload.Value, ".")
+	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
-		return "", fmt.Errorf("invalid jwt token: found %d parts", len(parts))
+		return fmt.Errorf("invalid jwt token: found %d parts", len(parts))
 	}
 
 	content := parts[1]
 
 	// Base64-decode the content.
-	token, err := base64.RawURLEncoding.DecodeString(content)
+	claims, err := base64.RawURLEncoding.DecodeString(content)
 	if err != nil {
-		return "", fmt.Errorf("base64.RawURLEncoding.DecodeString: %w", err)
-	}
-
-	// Extract fields from JSON payload.
-	var oidc struct {
-		JobWorkflowRef string `json:"job_workflow_ref"`
+		return fmt.Errorf("base64.RawURLEncoding.DecodeString: %w", err)
 	}
 
-	if err := json.Unmarshal(token, &oidc); err != nil {
-		return "", fmt.Errorf("json.Unmarshal: %w", err)
+	if err := json.Unmarshal(claims, v); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
 	}
-
-	if oidc.JobWorkflowRef == "" {
-		return "", fmt.Errorf("job_workflow_ref is empty")
-	}
-
-	return oidc.JobWorkflowRef, nil
+	return nil
 }
@@ -0,0 +1,172 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	slsa "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v0.2"
+)
+
+const predicateSLSAProvenanceV1 = "https://slsa.dev/provenance/v1"
+
+// Types of the SLSA v1.0 provenance predicate, which
+// in-toto-golang does not provide.
+// Spec: https://slsa.dev/spec/v1.0/provenance.
+type (
+	ProvenanceV1 struct {
+		BuildDefinition BuildDefinitionV1 `json:"buildDefinition"`
+		RunDetails      RunDetailsV1      `json:"runDetails"`
+	}
+	BuildDefinitionV1 struct {
+		BuildType            string                 `json:"buildType"`
+		ExternalParameters   interface{}            `json:"externalParameters"`
+		InternalParameters   interface{}            `json:"internalParameters,omitempty"`
+		ResolvedDependencies []ResourceDescriptorV1 `json:"resolvedDependencies,omitempty"`
+	}
+	RunDetailsV1 struct {
+		Builder  BuilderV1        `json:"builder"`
+		Metadata *BuildMetadataV1 `json:"metadata,omitempty"`
+	}
+	BuilderV1 struct {
+		ID                  string                 `json:"id"`
+		Version             map[string]string      `json:"version,omitempty"`
+		BuilderDependencies []ResourceDescriptorV1 `json:"builderDependencies,omitempty"`
+	}
+	BuildMetadataV1 struct {
+		InvocationID string `json:"invocationId,omitempty"`
+	}
+	ResourceDescriptorV1 struct {
+		URI    string            `json:"uri,omitempty"`
+		Digest map[string]string `json:"digest,omitempty"`
+		Name   string            `json:"name,omitempty"`
+	}
+
+	// ExternalParametersV1 are the parameters under the caller's control.
+	ExternalParametersV1 struct {
+		// Workflow is the caller's workflow that invoked the builder.
+		Workflow WorkflowV1 `json:"workflow"`
+		// Event holds the parameters coming from the trigger event.
+		Event Parameters `json:"event"`
+		// BuildConfig holds the command, env variables and
+		// configuration file ko was run with.
+		BuildConfig BuildConfig `json:"buildConfig"`
+	}
+	WorkflowV1 struct {
+		Ref        string `json:"ref"`
+		Repository string `json:"repository"`
+		Path       string `json:"path"`
+	}
+)
+
+// workflowPath returns the path of the caller's workflow in its
+// repository, from the workflow_ref of the GitHub context, like
+// org/repo/.github/workflows/release.yml@refs/tags/v1.2.3. It is empty
+// if the context does not have a valid reference.
+func workflowPath(gh *gitHubContext) string {
+	path := strings.TrimPrefix(gh.WorkflowRef, gh.Repository+"/")
+	if path == gh.WorkflowRef {
+		return ""
+	}
+	if i := strings.LastIndex(path, "@"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// generatePredicateV1 maps the same information as generatePredicate
+// into the SLSA v1.0 structure.
+func generatePredicateV1(gh *gitHubContext, com, env []string,
+	builder BuilderInfo, inputs buildInputs) *ProvenanceV1 {
+	repository := fmt.Sprintf("%s/%s", gh.ServerUrl, gh.Repository)
+
+	return &ProvenanceV1{
+		BuildDefinition: BuildDefinitionV1{
+			BuildType: buildType,
+			ExternalParameters: ExternalParametersV1{
+				Workflow: WorkflowV1{
+					Ref:        gh.Ref,
+					Repository: repository,
+					Path:       workflowPath(gh),
+				},
+				Event:       generateParameters(gh),
+				BuildConfig: generateBuildConfig(com, env, inputs),
+			},
+			// Non user-controllable environment vars needed to reproduce the build.
+			InternalParameters: generateEnvironment(gh, builder),
+			ResolvedDependencies: append([]ResourceDescriptorV1{
+				{
+					URI: fmt.Sprintf("git+%s@%s", repository, gh.Ref),
+					Digest: map[string]string{
+						"gitCommit": gh.SHA,
+					},
+				},
+			}, resolvedDependencies(inputs)...),
+		},
+		RunDetails: RunDetailsV1{
+			// Identifies the reusable workflow and matches the job_workflow_ref.
+			Builder: BuilderV1{
+				ID:                  builder.url(),
+				Version:             builderVersions(builder),
+				BuilderDependencies: builderDependencies(builder),
+			},
+			Metadata: &BuildMetadataV1{
+				InvocationID: fmt.Sprintf("%s/actions/runs/%s/attempts/%s",
+					repository, gh.RunID, gh.RunAttempt),
+			},
+		},
+	}
+}
+
+// resolvedDependencies returns the Go modules and the base images,
+// as generatePredicate records them as materials.
+func resolvedDependencies(inputs buildInputs) []ResourceDescriptorV1 {
+	return append(resourceDescriptors(moduleMaterials(inputs.modules)),
+		resourceDescriptors(baseImageMaterials(inputs.baseImages))...)
+}
+
+// builderVersions returns the versions of the builder and ko, if known.
+func builderVersions(builder BuilderInfo) map[string]string {
+	versions := make(map[string]string)
+	if v := builder.version(); v != "" {
+		versions["builder"] = v
+	}
+	if builder.KoVersion != "" {
+		versions["ko"] = builder.KoVersion
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions
+}
+
+// builderDependencies returns the builder's executable and
+// the ko release, as builderMaterials does for v0.2.
+func builderDependencies(builder BuilderInfo) []ResourceDescriptorV1 {
+	return resourceDescriptors(builderMaterials(builder))
+}
+
+// resourceDescriptors converts v0.2 materials.
+func resourceDescriptors(materials []slsa.ProvenanceMaterial) []ResourceDescriptorV1 {
+	var descriptors []ResourceDescriptorV1
+	for _, m := range materials {
+		descriptors = append(descriptors, ResourceDescriptorV1{
+			URI:    m.URI,
+			Digest: m.Digest,
+		})
+	}
+	return descriptors
+}
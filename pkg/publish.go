@@ -0,0 +1,251 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+var (
+	errorInvalidImage  = errors.New("invalid image reference")
+	errorNoImage       = errors.New("no image published")
+	errorKoFailed      = errors.New("ko failed")
+	errorInvalidDigest = errors.New("sha256 digest is not valid")
+)
+
+// Image is an image published by ko.
+type Image struct {
+	// Name is the image repository, e.g., ghcr.io/org/app.
+	Name string `json:"name"`
+	// Digest is the hex-encoded sha256 digest of the image manifest,
+	// or of the image index for multi-platform images.
+	Digest string `json:"digest"`
+	// Manifests are the images of each platform of an image index.
+	// They are only resolved for multi-platform builds.
+	Manifests []ImageManifest `json:"manifests,omitempty"`
+}
+
+// String returns the reference of the image by digest.
+func (i Image) String() string {
+	return fmt.Sprintf("%s@sha256:%s", i.Name, i.Digest)
+}
+
+// ParseImage parses a reference by digest of the form
+// registry/repository[:tag]@sha256:hex. The tag, if any, is dropped.
+func ParseImage(ref string) (*Image, error) {
+	parts := strings.Split(ref, "@")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%w: %s", errorInvalidImage, ref)
+	}
+
+	if !strings.HasPrefix(parts[1], "sha256:") {
+		return nil, fmt.Errorf("%w: %s", errorInvalidDigest, parts[1])
+	}
+	digest := strings.TrimPrefix(parts[1], "sha256:")
+	if err := validateDigest(digest); err != nil {
+		return nil, err
+	}
+
+	if _, err := name.NewDigest(ref); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errorInvalidImage, ref, err)
+	}
+
+	// Drop the tag. A `:` after the last `/` is a tag separator,
+	// otherwise it separates the registry's host and port.
+	repo := parts[0]
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+
+	return &Image{Name: repo, Digest: digest}, nil
+}
+
+// ParseImages parses a base64-encoded JSON list of references by digest,
+// as shared by the `images` output of RunAndCapture.
+func ParseImages(encoded string) ([]Image, error) {
+	refs, err := unmarshallList(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidImage, err)
+	}
+
+	images := make([]Image, 0, len(refs))
+	for _, ref := range refs {
+		image, err := ParseImage(ref)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, *image)
+	}
+	return images, nil
+}
+
+func validateDigest(digest string) error {
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != 64 ||
+		strings.ToLower(digest) != digest {
+		return fmt.Errorf("%w: %s", errorInvalidDigest, digest)
+	}
+	return nil
+}
+
+// RunAndCapture runs ko as a child process instead of replacing
+// the builder process, streams its logs and returns the images it published.
+// The images are also shared as the `image` and `images` outputs, and
+// the version of ko as the `ko-version` output, which the predicate
+// command records.
+func (b *KoBuild) RunAndCapture() ([]Image, error) {
+	command, err := b.generateCommandArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := b.koConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := koVersion(b.ko)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := b.runAndCapture(command, config)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("::set-output name=ko-version::%s\n", version)
+
+	return images, nil
+}
+
+// runAndCapture runs ko with the ko configuration config, as returned
+// by koConfig.
+func (b *KoBuild) runAndCapture(command []string, config *KoConfigFile) ([]Image, error) {
+	// ko is not run if the registry is invalid.
+	if _, err := b.generateRegistry(); err != nil {
+		return nil, err
+	}
+
+	cleanup, err := b.useExpandedKoConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	envs, err := b.generateEnvVariables()
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := b.publish(command, envs)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]string, 0, len(images))
+	for _, image := range images {
+		refs = append(refs, image.String())
+	}
+	encoded, err := marshallList(refs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The `image` output is only set for a single image,
+	// to avoid picking one arbitrarily.
+	if len(images) == 1 {
+		fmt.Printf("::set-output name=image::%s\n", images[0])
+	}
+	fmt.Printf("::set-output name=images::%s\n", encoded)
+
+	return images, nil
+}
+
+// publish runs ko and returns the images it published. The standard
+// output of ko is parsed and forwarded to the builder's standard error,
+// like ko's, so that it does not mix with the outputs of the builder.
+// Since the runner interprets workflow commands on both streams, they
+// are disabled while ko runs, with a token that the build cannot guess.
+func (b *KoBuild) publish(command, envs []string) ([]Image, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorKoFailed, err)
+	}
+	resume := hex.EncodeToString(token)
+
+	var stdout bytes.Buffer
+	cmd := &exec.Cmd{
+		Path:   b.ko,
+		Args:   command,
+		Env:    envs,
+		Stdout: io.MultiWriter(os.Stderr, &stdout),
+		Stderr: os.Stderr,
+	}
+	fmt.Fprintf(os.Stderr, "::stop-commands::%s\n", resume)
+	err := cmd.Run()
+	fmt.Fprintf(os.Stderr, "::%s::\n", resume)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorKoFailed, err)
+	}
+
+	return parseKoOutput(&stdout)
+}
+
+// parseKoOutput extracts the references of the published images,
+// which ko prints to its standard output, one per line.
+func parseKoOutput(r io.Reader) ([]Image, error) {
+	var images []Image
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.Contains(line, "@sha256:") {
+			continue
+		}
+
+		image, err := ParseImage(line)
+		if err != nil {
+			return nil, err
+		}
+
+		// The same image may be printed several times,
+		// e.g., for an import path given twice.
+		if seen[image.String()] {
+			continue
+		}
+		seen[image.String()] = true
+		images = append(images, *image)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(images) == 0 {
+		return nil, errorNoImage
+	}
+
+	return images, nil
+}
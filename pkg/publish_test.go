@@ -0,0 +1,255 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	testDigest1 = "a4b3e2b7a7c9d4e55bde1b0c5b2e8e7d3f8a3b4c5d6e7f8091a2b3c4d5e6f708"
+	testDigest2 = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	testDigest3 = "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+)
+
+func Test_ParseImage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		ref      string
+		expected *Image
+		err      error
+	}{
+		{
+			name:     "ghcr image",
+			ref:      "ghcr.io/org/app@sha256:" + testDigest1,
+			expected: &Image{Name: "ghcr.io/org/app", Digest: testDigest1},
+		},
+		{
+			name:     "image with tag",
+			ref:      "ghcr.io/org/app:v1.2.3@sha256:" + testDigest1,
+			expected: &Image{Name: "ghcr.io/org/app", Digest: testDigest1},
+		},
+		{
+			name:     "registry with port",
+			ref:      "localhost:5000/a/b@sha256:" + testDigest1,
+			expected: &Image{Name: "localhost:5000/a/b", Digest: testDigest1},
+		},
+		{
+			name:     "registry with port and tag",
+			ref:      "localhost:5000/a/b:latest@sha256:" + testDigest1,
+			expected: &Image{Name: "localhost:5000/a/b", Digest: testDigest1},
+		},
+		{
+			name: "no digest",
+			ref:  "ghcr.io/org/app:latest",
+			err:  errorInvalidImage,
+		},
+		{
+			name: "short digest",
+			ref:  "ghcr.io/org/app@sha256:abcdef",
+			err:  errorInvalidDigest,
+		},
+		{
+			name: "uppercase digest",
+			ref:  "ghcr.io/org/app@sha256:" + strings.ToUpper(testDigest1),
+			err:  errorInvalidDigest,
+		},
+		{
+			name: "other algorithm",
+			ref:  "ghcr.io/org/app@sha512:" + testDigest1,
+			err:  errorInvalidDigest,
+		},
+		{
+			name: "invalid repository",
+			ref:  "ghcr.io/Org/app@sha256:" + testDigest1,
+			err:  errorInvalidImage,
+		},
+		{
+			name: "several digests",
+			ref:  "ghcr.io/org/app@sha256:" + testDigest1 + "@sha256:" + testDigest1,
+			err:  errorInvalidImage,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			image, err := ParseImage(tt.ref)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(image, tt.expected) {
+				t.Errorf(cmp.Diff(image, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_parseKoOutput(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		output   string
+		expected []Image
+		err      error
+	}{
+		{
+			name:     "single image",
+			output:   "ghcr.io/org/app@sha256:" + testDigest1 + "\n",
+			expected: []Image{{Name: "ghcr.io/org/app", Digest: testDigest1}},
+		},
+		{
+			name: "multiple images",
+			output: "ghcr.io/org/a@sha256:" + testDigest1 + "\n" +
+				"  ghcr.io/org/b@sha256:" + testDigest2 + "  \n" +
+				"ghcr.io/org/a@sha256:" + testDigest1 + "\n",
+			expected: []Image{
+				{Name: "ghcr.io/org/a", Digest: testDigest1},
+				{Name: "ghcr.io/org/b", Digest: testDigest2},
+			},
+		},
+		{
+			name:     "other lines",
+			output:   "some log\n\nghcr.io/org/app@sha256:" + testDigest1,
+			expected: []Image{{Name: "ghcr.io/org/app", Digest: testDigest1}},
+		},
+		{
+			name:   "no image",
+			output: "some log\n",
+			err:    errorNoImage,
+		},
+		{
+			name:   "invalid digest",
+			output: "ghcr.io/org/app@sha256:1234\n",
+			err:    errorInvalidDigest,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			images, err := parseKoOutput(strings.NewReader(tt.output))
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(images, tt.expected) {
+				t.Errorf(cmp.Diff(images, tt.expected))
+			}
+		})
+	}
+}
+
+// writeFakeKo writes a script that prints the given output and
+// exits with the given code, in place of ko. `ko version` prints
+// testKoVersion.
+func writeFakeKo(t *testing.T, output string, code int) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ko")
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = version ]; then echo %s; exit 0; fi\n"+
+		"echo 'log line' >&2\nprintf '%%s' '%s'\nexit %d\n", testKoVersion, output, code)
+	if err := ioutil.WriteFile(path, []byte(script), 0o700); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func Test_RunAndCapture(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		output   string
+		code     int
+		envs     string
+		expected []Image
+		err      error
+	}{
+		{
+			name:   "published images",
+			output: "ghcr.io/org/a@sha256:" + testDigest1 + "\nghcr.io/org/b@sha256:" + testDigest2 + "\n",
+			expected: []Image{
+				{Name: "ghcr.io/org/a", Digest: testDigest1},
+				{Name: "ghcr.io/org/b", Digest: testDigest2},
+			},
+		},
+		{
+			name:   "ko failure",
+			output: "ghcr.io/org/a@sha256:" + testDigest1 + "\n",
+			code:   1,
+			err:    errorKoFailed,
+		},
+		{
+			name:   "denied ko configuration",
+			output: "ghcr.io/org/a@sha256:" + testDigest1 + "\n",
+			envs:   "KO_CONFIG_PATH=testdata/koconfig/denied-env.yaml",
+			err:    errorInvalidKoConfig,
+		},
+		{
+			name:   "templated ldflags without the GitHub context",
+			output: "ghcr.io/org/a@sha256:" + testDigest1 + "\n",
+			envs:   "KO_CONFIG_PATH=testdata/koconfig/ldflags.yaml",
+			err:    errorInvalidKoConfig,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			b := KoBuildNew(writeFakeKo(t, tt.output, tt.code))
+			if err := b.SetArgEnvVariables("KO_DOCKER_REPO=ghcr.io/org"); err != nil {
+				t.Fatalf("SetArgEnvVariables: %v", err)
+			}
+			if err := b.SetArgEnvVariables(tt.envs); err != nil {
+				t.Fatalf("SetArgEnvVariables: %v", err)
+			}
+			if err := b.SetArgs("./cmd/a ./cmd/b"); err != nil {
+				t.Fatalf("SetArgs: %v", err)
+			}
+
+			images, err := b.RunAndCapture()
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(images, tt.expected) {
+				t.Errorf(cmp.Diff(images, tt.expected))
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+var dockerRegistry = "docker.io"
+
+// Registry is the destination of the images, as configured
+// by KO_DOCKER_REPO. See https://github.com/google/ko#choose-destination.
+type Registry struct {
+	// Host is the registry host, without the port.
+	Host string `json:"host"`
+	// Port is the registry port, if set.
+	Port string `json:"port,omitempty"`
+	// Repository is the repository path under which ko pushes images.
+	Repository string `json:"repository"`
+}
+
+// Address returns the host and port of the registry.
+func (r *Registry) Address() string {
+	if r.Port == "" {
+		return r.Host
+	}
+	return net.JoinHostPort(r.Host, r.Port)
+}
+
+// Registry returns the destination of the images,
+// as configured by the KO_DOCKER_REPO env variable.
+func (b *KoBuild) Registry() (*Registry, error) {
+	return b.generateRegistry()
+}
+
+func (b *KoBuild) generateRegistry() (*Registry, error) {
+	return parseRegistry(strings.Trim(b.envs["KO_DOCKER_REPO"], " "))
+}
+
+func parseRegistry(repo string) (*Registry, error) {
+	// Empty registry is allowed, default to docker.
+	if repo == "" {
+		return &Registry{Host: dockerRegistry}, nil
+	}
+
+	// ko.local and kind.local load the images into a local daemon
+	// instead of pushing them to a registry.
+	// See https://github.com/google/ko#local-publishing-options.
+	host := strings.SplitN(repo, "/", 2)[0]
+	if host == "ko.local" || host == "kind.local" {
+		return nil, fmt.Errorf("%w: %s: images must be pushed to a registry", errorInvalidRegistry, repo)
+	}
+
+	// Split with the same semantics as Docker: the first component
+	// is a registry only if it contains a `.` or a `:`, or is `localhost`.
+	// Otherwise, the repository is on Docker Hub.
+	// See https://github.com/distribution/distribution/blob/main/reference/normalize.go.
+	host, path := "", repo
+	if parts := strings.SplitN(repo, "/", 2); len(parts) == 2 &&
+		(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		host, path = parts[0], parts[1]
+	}
+
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errorInvalidRegistry, repo, err)
+	}
+	// Validate the path as a repository on an explicit registry,
+	// so that its first component is not mistaken for a registry.
+	if _, err := name.NewRepository(dockerRegistry + "/" + path); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errorInvalidRegistry, repo, err)
+	}
+
+	r := &Registry{
+		Host:       reg.RegistryStr(),
+		Repository: path,
+	}
+
+	if r.Host == name.DefaultRegistry {
+		r.Host = dockerRegistry
+		return r, nil
+	}
+
+	if h, p, err := net.SplitHostPort(r.Host); err == nil {
+		r.Host, r.Port = h, p
+	}
+
+	return r, nil
+}
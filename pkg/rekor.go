@@ -0,0 +1,379 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cyberphone/json-canonicalization/go/src/webpki.org/jsoncanonicalizer"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+var (
+	errorRekorFailed       = errors.New("rekor upload failed")
+	errorInvalidRekorSET   = errors.New("invalid rekor signed entry timestamp")
+	errorInvalidRekorKey   = errors.New("invalid rekor public key")
+	errorInvalidRekorEntry = errors.New("invalid rekor entry")
+)
+
+// defaultRekorPublicKey is the key that signs the entries of the
+// public Rekor instance. Its SHA-256 digest is the log ID.
+const defaultRekorPublicKey = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE2G2Y+2tabdTV5BcGiBIx0a9fAFwr
+kBbmLSGtks4L3qX6yYY0zufBnhC8Ur/iy55GhWP/9A/bY2LhC30M9+RYtw==
+-----END PUBLIC KEY-----
+`
+
+// RekorClient uploads entries to a Rekor transparency log.
+type RekorClient interface {
+	// CreateEntry uploads the JSON-encoded proposed entry
+	// and returns the bundle of the resulting log entry.
+	CreateEntry(proposedEntry []byte) (*RekorBundle, error)
+	// PublicKey returns the key that signs the entries of the log.
+	PublicKey() *ecdsa.PublicKey
+}
+
+// ParseRekorPublicKey parses the PEM-encoded ECDSA key of a Rekor instance.
+func ParseRekorPublicKey(key []byte) (*ecdsa.PublicKey, error) {
+	publicKey, err := cryptoutils.UnmarshalPEMToPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidRekorKey, err)
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an ECDSA key", errorInvalidRekorKey)
+	}
+	return ecdsaKey, nil
+}
+
+// LoadRekorPublicKeyFile reads the PEM-encoded ECDSA key of a Rekor instance.
+func LoadRekorPublicKeyFile(path string) (*ecdsa.PublicKey, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidRekorKey, err)
+	}
+	return ParseRekorPublicKey(key)
+}
+
+// rekorPublicKey returns the public key, or the key of the public
+// instance if it is nil and url is the public instance's.
+func rekorPublicKey(url string, publicKey *ecdsa.PublicKey) (*ecdsa.PublicKey, error) {
+	if publicKey != nil {
+		return publicKey, nil
+	}
+	if url != "" && strings.TrimSuffix(url, "/") != defaultRekorAddr {
+		return nil, fmt.Errorf("%w: the public key of %s is required", errorInvalidRekorKey, url)
+	}
+	return ParseRekorPublicKey([]byte(defaultRekorPublicKey))
+}
+
+// RekorBundle holds the proof that an entry is in the log, so that
+// it can be checked offline. It extends cosign's bundle with the
+// inclusion proof.
+type RekorBundle struct {
+	// SignedEntryTimestamp is the log's signature of the payload.
+	SignedEntryTimestamp []byte
+	Payload              RekorPayload
+	InclusionProof       *RekorInclusionProof `json:",omitempty"`
+}
+
+// RekorPayload describes a log entry.
+type RekorPayload struct {
+	// Body is the base64-encoded canonical entry.
+	Body           interface{} `json:"body"`
+	IntegratedTime int64       `json:"integratedTime"`
+	LogIndex       int64       `json:"logIndex"`
+	LogID          string      `json:"logID"`
+}
+
+// RekorInclusionProof is the Merkle proof of inclusion of an entry.
+type RekorInclusionProof struct {
+	LogIndex int64    `json:"logIndex"`
+	RootHash string   `json:"rootHash"`
+	TreeSize int64    `json:"treeSize"`
+	Hashes   []string `json:"hashes"`
+}
+
+// VerifySET checks that the signed entry timestamp
+// is the log's signature of the payload.
+func (b *RekorBundle) VerifySET(publicKey *ecdsa.PublicKey) error {
+	payload, err := b.Payload.canonical()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errorInvalidRekorSET, err)
+	}
+	hash := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(publicKey, hash[:], b.SignedEntryTimestamp) {
+		return errorInvalidRekorSET
+	}
+	return nil
+}
+
+// canonical returns the RFC 8785 encoding of the payload,
+// which the signed entry timestamp signs.
+func (p RekorPayload) canonical() ([]byte, error) {
+	content, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return jsoncanonicalizer.Transform(content)
+}
+
+// rekorIntotoBody is the body of an intoto v0.0.1 log entry. Rekor
+// records the digest of the envelope rather than the envelope.
+type rekorIntotoBody struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Content struct {
+			Envelope string `json:"envelope,omitempty"`
+			Hash     *struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash,omitempty"`
+		} `json:"content"`
+		PublicKey []byte `json:"publicKey"`
+	} `json:"spec"`
+}
+
+// checkEntry checks that the logged entry is the intoto entry of the
+// envelope, verified by the PEM-encoded public key or certificate.
+func (b *RekorBundle) checkEntry(envelope, publicKey []byte) error {
+	encoded, ok := b.Payload.Body.(string)
+	if !ok {
+		return fmt.Errorf("%w: the body is not a string", errorInvalidRekorEntry)
+	}
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errorInvalidRekorEntry, err)
+	}
+	var body rekorIntotoBody
+	if err := json.Unmarshal(content, &body); err != nil {
+		return fmt.Errorf("%w: %v", errorInvalidRekorEntry, err)
+	}
+
+	if body.Kind != "intoto" || body.APIVersion != "0.0.1" {
+		return fmt.Errorf("%w: unexpected entry type %s %s", errorInvalidRekorEntry, body.Kind, body.APIVersion)
+	}
+	if !bytes.Equal(body.Spec.PublicKey, publicKey) {
+		return fmt.Errorf("%w: unexpected public key", errorInvalidRekorEntry)
+	}
+	digest := sha256.Sum256(envelope)
+	switch c := body.Spec.Content; {
+	case c.Envelope != "":
+		if c.Envelope != string(envelope) {
+			return fmt.Errorf("%w: unexpected envelope", errorInvalidRekorEntry)
+		}
+	case c.Hash != nil:
+		if c.Hash.Algorithm != "sha256" || c.Hash.Value != hex.EncodeToString(digest[:]) {
+			return fmt.Errorf("%w: unexpected envelope digest", errorInvalidRekorEntry)
+		}
+	default:
+		return fmt.Errorf("%w: no envelope", errorInvalidRekorEntry)
+	}
+	return nil
+}
+
+// checkIntegratedTime checks that the entry was logged
+// while the certificate was valid.
+func (b *RekorBundle) checkIntegratedTime(cert *x509.Certificate) error {
+	integrated := time.Unix(b.Payload.IntegratedTime, 0)
+	if integrated.Before(cert.NotBefore) || integrated.After(cert.NotAfter) {
+		return fmt.Errorf("%w: logged at %s, outside of the certificate's validity [%s, %s]",
+			errorInvalidRekorEntry, integrated.UTC().Format(time.RFC3339),
+			cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// rekorHTTPClient is a client of the Rekor v1 API.
+// See https://github.com/sigstore/rekor/blob/main/openapi.yaml.
+type rekorHTTPClient struct {
+	url       string
+	publicKey *ecdsa.PublicKey
+	client    *http.Client
+}
+
+// NewRekorClient returns a client of the Rekor instance at url,
+// or of the public instance if url is empty, whose entries are signed
+// by publicKey. The key is only optional for the public instance.
+func NewRekorClient(url string, publicKey *ecdsa.PublicKey) (RekorClient, error) {
+	publicKey, err := rekorPublicKey(url, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if url == "" {
+		url = defaultRekorAddr
+	}
+	return &rekorHTTPClient{
+		url:       strings.TrimSuffix(url, "/"),
+		publicKey: publicKey,
+		client:    http.DefaultClient,
+	}, nil
+}
+
+func (c *rekorHTTPClient) PublicKey() *ecdsa.PublicKey {
+	return c.publicKey
+}
+
+// rekorLogEntry is a log entry returned by Rekor.
+type rekorLogEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+	Verification   struct {
+		InclusionProof       *RekorInclusionProof `json:"inclusionProof,omitempty"`
+		SignedEntryTimestamp []byte               `json:"signedEntryTimestamp"`
+	} `json:"verification"`
+}
+
+func (c *rekorHTTPClient) CreateEntry(proposedEntry []byte) (*RekorBundle, error) {
+	req, err := http.NewRequest("POST", c.url+"/api/v1/log/entries", bytes.NewReader(proposedEntry))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("%w: %s: %s", errorRekorFailed, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// The entries are keyed by their UUID.
+	var entries map[string]rekorLogEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("%w: expected one entry, got %d", errorRekorFailed, len(entries))
+	}
+
+	var bundle *RekorBundle
+	for _, e := range entries {
+		bundle = &RekorBundle{
+			SignedEntryTimestamp: e.Verification.SignedEntryTimestamp,
+			Payload: RekorPayload{
+				Body:           e.Body,
+				IntegratedTime: e.IntegratedTime,
+				LogIndex:       e.LogIndex,
+				LogID:          e.LogID,
+			},
+			InclusionProof: e.Verification.InclusionProof,
+		}
+	}
+	return bundle, nil
+}
+
+// rekorIntotoEntry is a proposed intoto v0.0.1 entry.
+// See https://github.com/sigstore/rekor/tree/main/pkg/types/intoto.
+type rekorIntotoEntry struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Content struct {
+			// Envelope is the JSON-encoded DSSE envelope.
+			Envelope string `json:"envelope"`
+		} `json:"content"`
+		// PublicKey is the PEM-encoded public key or certificate
+		// that verifies the envelope.
+		PublicKey []byte `json:"publicKey"`
+	} `json:"spec"`
+}
+
+func newRekorIntotoEntry(envelope, publicKey []byte) ([]byte, error) {
+	entry := rekorIntotoEntry{APIVersion: "0.0.1", Kind: "intoto"}
+	entry.Spec.Content.Envelope = string(envelope)
+	entry.Spec.PublicKey = publicKey
+	return json.Marshal(entry)
+}
+
+// signerPublicKey returns the PEM-encoded certificate of a
+// keyless signer, or the public key of other signers.
+func signerPublicKey(signer signature.Signer) ([]byte, error) {
+	if s, ok := signer.(*KeylessSigner); ok {
+		certs, err := cryptoutils.UnmarshalCertificatesFromPEM(s.CertificateChain())
+		if err != nil {
+			return nil, err
+		}
+		return cryptoutils.MarshalCertificateToPEM(certs[0])
+	}
+
+	publicKey, err := signer.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return cryptoutils.MarshalPublicKeyToPEM(publicKey)
+}
+
+// uploadEnvelope records a signed envelope in the log. The returned
+// bundle is checked, since the log is not trusted to record the entry
+// as submitted.
+func uploadEnvelope(rekor RekorClient, envelope []byte, signer signature.Signer) (*RekorBundle, error) {
+	publicKey, err := signerPublicKey(signer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+	}
+
+	entry, err := newRekorIntotoEntry(envelope, publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+	}
+
+	bundle, err := rekor.CreateEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bundle.VerifySET(rekor.PublicKey()); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+	}
+	if err := bundle.checkEntry(envelope, publicKey); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+	}
+	if s, ok := signer.(*KeylessSigner); ok {
+		certs, err := cryptoutils.UnmarshalCertificatesFromPEM(s.CertificateChain())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+		}
+		if err := bundle.checkIntegratedTime(certs[0]); err != nil {
+			return nil, fmt.Errorf("%w: %v", errorRekorFailed, err)
+		}
+	}
+	return bundle, nil
+}
@@ -0,0 +1,507 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyberphone/json-canonicalization/go/src/webpki.org/jsoncanonicalizer"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	sigdsse "github.com/sigstore/sigstore/pkg/signature/dsse"
+)
+
+// fakeRekor is an in-process transparency log that accepts
+// intoto entries whose envelope verifies with their public key.
+// It does not maintain a Merkle tree: each inclusion proof is
+// for a tree made of the entry alone.
+type fakeRekor struct {
+	key *ecdsa.PrivateKey
+	// integratedTime, if set, is the time of all the entries.
+	integratedTime time.Time
+
+	mu      sync.Mutex
+	entries [][]byte
+}
+
+func newFakeRekor(t *testing.T) *fakeRekor {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	return &fakeRekor{key: key}
+}
+
+func (r *fakeRekor) PublicKey() *ecdsa.PublicKey {
+	return &r.key.PublicKey
+}
+
+func (r *fakeRekor) CreateEntry(proposedEntry []byte) (*RekorBundle, error) {
+	var entry rekorIntotoEntry
+	if err := json.Unmarshal(proposedEntry, &entry); err != nil {
+		return nil, err
+	}
+	if entry.APIVersion != "0.0.1" || entry.Kind != "intoto" {
+		return nil, fmt.Errorf("unsupported entry: %s %s", entry.Kind, entry.APIVersion)
+	}
+
+	// The public key is either a certificate or a key.
+	var publicKey crypto.PublicKey
+	if certs, err := cryptoutils.UnmarshalCertificatesFromPEM(entry.Spec.PublicKey); err == nil && len(certs) == 1 {
+		publicKey = certs[0].PublicKey
+	} else if publicKey, err = cryptoutils.UnmarshalPEMToPublicKey(entry.Spec.PublicKey); err != nil {
+		return nil, err
+	}
+	verifier, err := signature.LoadVerifier(publicKey, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	if err := sigdsse.WrapVerifier(verifier).VerifySignature(
+		bytes.NewReader([]byte(entry.Spec.Content.Envelope)), nil); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+
+	body, err := jsoncanonicalizer.Transform(proposedEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	index := int64(len(r.entries))
+	r.entries = append(r.entries, body)
+	r.mu.Unlock()
+
+	der, err := x509.MarshalPKIXPublicKey(r.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	logID := sha256.Sum256(der)
+	integratedTime := time.Now()
+	if !r.integratedTime.IsZero() {
+		integratedTime = r.integratedTime
+	}
+	payload := RekorPayload{
+		Body:           base64.StdEncoding.EncodeToString(body),
+		IntegratedTime: integratedTime.Unix(),
+		LogIndex:       index,
+		LogID:          hex.EncodeToString(logID[:]),
+	}
+	canonical, err := payload.canonical()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(canonical)
+	set, err := ecdsa.SignASN1(rand.Reader, r.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := sha256.Sum256(append([]byte{0}, body...))
+	return &RekorBundle{
+		SignedEntryTimestamp: set,
+		Payload:              payload,
+		InclusionProof: &RekorInclusionProof{
+			LogIndex: index,
+			RootHash: hex.EncodeToString(leaf[:]),
+			TreeSize: 1,
+			Hashes:   []string{},
+		},
+	}, nil
+}
+
+func Test_uploadEnvelope(t *testing.T) {
+	t.Parallel()
+
+	rekor := newFakeRekor(t)
+	signer := newTestSigner(t)
+	keyless, err := NewKeylessSigner(newFakeFulcio(t), testJWT(t, map[string]string{
+		"sub":              "repo:org/repo:ref:refs/tags/v1.2.3",
+		"job_workflow_ref": testJobWorkflowRef,
+	}))
+	if err != nil {
+		t.Fatalf("NewKeylessSigner: %v", err)
+	}
+
+	statement := []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`)
+	sign := func(s signature.Signer) []byte {
+		envelope, err := SignStatement(statement, s)
+		if err != nil {
+			t.Fatalf("SignStatement: %v", err)
+		}
+		return envelope
+	}
+
+	tests := []struct {
+		name     string
+		envelope []byte
+		signer   signature.Signer
+		err      error
+	}{
+		{
+			name:     "key",
+			envelope: sign(signer),
+			signer:   signer,
+		},
+		{
+			name:     "keyless",
+			envelope: sign(keyless),
+			signer:   keyless,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			bundle, err := uploadEnvelope(rekor, tt.envelope, tt.signer)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+
+			if err := bundle.VerifySET(&rekor.key.PublicKey); err != nil {
+				t.Errorf("VerifySET: %v", err)
+			}
+
+			// The body is the entry of the envelope.
+			body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body.(string))
+			if err != nil {
+				t.Fatalf("base64.StdEncoding.DecodeString: %v", err)
+			}
+			var entry rekorIntotoEntry
+			if err := json.Unmarshal(body, &entry); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			if entry.Spec.Content.Envelope != string(tt.envelope) {
+				t.Errorf(cmp.Diff(entry.Spec.Content.Envelope, string(tt.envelope)))
+			}
+
+			// The SET covers the payload.
+			bundle.Payload.LogIndex++
+			if err := bundle.VerifySET(&rekor.key.PublicKey); !errCmp(err, errorInvalidRekorSET) {
+				t.Errorf(cmp.Diff(err, errorInvalidRekorSET))
+			}
+		})
+	}
+}
+
+// untrustedRekor is a log that does not sign its entries with the
+// expected key, or that logs another entry than the submitted one.
+type untrustedRekor struct {
+	*fakeRekor
+	// publicKey is the key the builder expects.
+	publicKey *ecdsa.PublicKey
+	// entry, if set, is logged instead of the submitted entry.
+	entry []byte
+}
+
+func (r *untrustedRekor) CreateEntry(proposedEntry []byte) (*RekorBundle, error) {
+	if r.entry != nil {
+		proposedEntry = r.entry
+	}
+	return r.fakeRekor.CreateEntry(proposedEntry)
+}
+
+func (r *untrustedRekor) PublicKey() *ecdsa.PublicKey {
+	if r.publicKey != nil {
+		return r.publicKey
+	}
+	return r.fakeRekor.PublicKey()
+}
+
+func Test_uploadEnvelope_untrustedLog(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestSigner(t)
+	sign := func(statement string) []byte {
+		envelope, err := SignStatement([]byte(statement), signer)
+		if err != nil {
+			t.Fatalf("SignStatement: %v", err)
+		}
+		return envelope
+	}
+	envelope := sign(`{"_type":"https://in-toto.io/Statement/v0.1"}`)
+	publicKey, err := signerPublicKey(signer)
+	if err != nil {
+		t.Fatalf("signerPublicKey: %v", err)
+	}
+	other, err := newRekorIntotoEntry(sign(`{"_type":"https://in-toto.io/Statement/v0.1","subject":[]}`), publicKey)
+	if err != nil {
+		t.Fatalf("newRekorIntotoEntry: %v", err)
+	}
+
+	keyless, err := NewKeylessSigner(newFakeFulcio(t), testJWT(t, map[string]string{
+		"sub":              "repo:org/repo:ref:refs/tags/v1.2.3",
+		"job_workflow_ref": testJobWorkflowRef,
+	}))
+	if err != nil {
+		t.Fatalf("NewKeylessSigner: %v", err)
+	}
+	keylessEnvelope, err := SignStatement([]byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`), keyless)
+	if err != nil {
+		t.Fatalf("SignStatement: %v", err)
+	}
+	late := newFakeRekor(t)
+	late.integratedTime = time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		rekor    RekorClient
+		envelope []byte
+		signer   signature.Signer
+	}{
+		{
+			name:     "another log's key",
+			rekor:    &untrustedRekor{fakeRekor: newFakeRekor(t), publicKey: &newFakeRekor(t).key.PublicKey},
+			envelope: envelope,
+			signer:   signer,
+		},
+		{
+			name:     "another entry",
+			rekor:    &untrustedRekor{fakeRekor: newFakeRekor(t), entry: other},
+			envelope: envelope,
+			signer:   signer,
+		},
+		{
+			name:     "logged after the certificate expired",
+			rekor:    late,
+			envelope: keylessEnvelope,
+			signer:   keyless,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := uploadEnvelope(tt.rekor, tt.envelope, tt.signer)
+			if !errCmp(err, errorRekorFailed) {
+				t.Errorf(cmp.Diff(err, errorRekorFailed))
+			}
+		})
+	}
+}
+
+func Test_NewRekorClient(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		url       string
+		publicKey *ecdsa.PublicKey
+		err       error
+	}{
+		{
+			name: "public instance",
+		},
+		{
+			name: "public instance url",
+			url:  defaultRekorAddr + "/",
+		},
+		{
+			name:      "instance with its key",
+			url:       "https://rekor.example.com",
+			publicKey: &newFakeRekor(t).key.PublicKey,
+		},
+		{
+			name: "instance without its key",
+			url:  "https://rekor.example.com",
+			err:  errorInvalidRekorKey,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, err := NewRekorClient(tt.url, tt.publicKey)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			if client.PublicKey() == nil {
+				t.Errorf("expected a public key")
+			}
+		})
+	}
+}
+
+func Test_rekorHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	rekor := newFakeRekor(t)
+
+	// serve returns the log entries created by the fake,
+	// count times in the response.
+	serve := func(count int) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.Path != "/api/v1/log/entries" {
+				http.NotFound(w, r)
+				return
+			}
+			var entry bytes.Buffer
+			if _, err := entry.ReadFrom(r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			bundle, err := rekor.CreateEntry(entry.Bytes())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			e := rekorLogEntry{
+				Body:           bundle.Payload.Body.(string),
+				IntegratedTime: bundle.Payload.IntegratedTime,
+				LogIndex:       bundle.Payload.LogIndex,
+				LogID:          bundle.Payload.LogID,
+			}
+			e.Verification.SignedEntryTimestamp = bundle.SignedEntryTimestamp
+			e.Verification.InclusionProof = bundle.InclusionProof
+			entries := make(map[string]rekorLogEntry)
+			for i := 0; i < count; i++ {
+				entries[fmt.Sprintf("uuid%d", i)] = e
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(entries)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	one := serve(1)
+	two := serve(2)
+
+	signer := newTestSigner(t)
+	envelope, err := SignStatement([]byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`), signer)
+	if err != nil {
+		t.Fatalf("SignStatement: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		signer signature.Signer
+		err    error
+	}{
+		{
+			name:   "entry created",
+			url:    one.URL,
+			signer: signer,
+		},
+		{
+			name:   "entry rejected",
+			url:    one.URL,
+			signer: newTestSigner(t),
+			err:    errorRekorFailed,
+		},
+		{
+			name:   "several entries",
+			url:    two.URL,
+			signer: signer,
+			err:    errorRekorFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, err := NewRekorClient(tt.url, &rekor.key.PublicKey)
+			if err != nil {
+				t.Fatalf("NewRekorClient: %v", err)
+			}
+			bundle, err := uploadEnvelope(client, envelope, tt.signer)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+			if err := bundle.VerifySET(&rekor.key.PublicKey); err != nil {
+				t.Errorf("VerifySET: %v", err)
+			}
+			if bundle.InclusionProof == nil {
+				t.Errorf("expected an inclusion proof")
+			}
+		})
+	}
+}
+
+func Test_generateAttestations_tlog(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	rekor := newFakeRekor(t)
+	images := []Image{
+		{Name: "ghcr.io/org/a", Digest: testDigest1},
+		{Name: "ghcr.io/org/b", Digest: testDigest2},
+	}
+
+	opts, err := AttestationOptions{
+		Format: FormatStatement,
+		Signer: newTestSigner(t),
+		Rekor:  rekor,
+	}.normalize()
+	if err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	attestations, err := generateAttestations(images, gh, []string{"ko", "publish"}, nil, testBuilder, opts)
+	if err != nil {
+		t.Fatalf("generateAttestations: %v", err)
+	}
+	for _, att := range attestations {
+		if att.Bundle == nil {
+			t.Fatalf("%s: missing bundle", att.Filename)
+		}
+		if err := att.Bundle.VerifySET(&rekor.key.PublicKey); err != nil {
+			t.Errorf("%s: VerifySET: %v", att.Filename, err)
+		}
+	}
+
+	// Only signed attestations are uploaded.
+	_, err = AttestationOptions{Format: FormatStatement, Rekor: rekor}.normalize()
+	if !errCmp(err, errorRekorFailed) {
+		t.Errorf(cmp.Diff(err, errorRekorFailed))
+	}
+}
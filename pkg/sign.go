@@ -0,0 +1,124 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	intoto "github.com/in-toto/in-toto-golang/in_toto"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/dsse"
+)
+
+var (
+	errorInvalidSigningKey = errors.New("invalid signing key")
+	errorSigningFailed     = errors.New("signing failed")
+)
+
+// PEM types of the private keys LoadSigningKey accepts.
+const (
+	pemTypePrivateKey           = "PRIVATE KEY"
+	pemTypeECPrivateKey         = "EC PRIVATE KEY"
+	pemTypeEncryptedCosignKey   = "ENCRYPTED COSIGN PRIVATE KEY"
+	pemTypeEncryptedSigstoreKey = "ENCRYPTED SIGSTORE PRIVATE KEY"
+)
+
+// LoadSigningKeyFile reads a private key from a file.
+// See LoadSigningKey.
+func LoadSigningKeyFile(path string, password []byte) (signature.SignerVerifier, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidSigningKey, err)
+	}
+	return LoadSigningKey(key, password)
+}
+
+// LoadSigningKey parses a PEM-encoded ECDSA P-256 or Ed25519 private key.
+// The key is either unencrypted, in PKCS #8 or SEC 1 form, or encrypted
+// by `cosign generate-key-pair`, in which case the password decrypts it.
+func LoadSigningKey(key, password []byte) (signature.SignerVerifier, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block", errorInvalidSigningKey)
+	}
+
+	var (
+		priv crypto.PrivateKey
+		err  error
+	)
+	switch block.Type {
+	case pemTypePrivateKey:
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	case pemTypeECPrivateKey:
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+
+	case pemTypeEncryptedCosignKey, pemTypeEncryptedSigstoreKey:
+		if len(password) == 0 {
+			return nil, fmt.Errorf("%w: a password is required for %s", errorInvalidSigningKey, block.Type)
+		}
+		priv, err = cryptoutils.UnmarshalPEMToPrivateKey(key, func(bool) ([]byte, error) {
+			return password, nil
+		})
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported PEM type %s", errorInvalidSigningKey, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidSigningKey, err)
+	}
+
+	switch k := priv.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: unsupported curve %s", errorInvalidSigningKey, k.Curve.Params().Name)
+		}
+		return signature.LoadECDSASignerVerifier(k, crypto.SHA256)
+	case ed25519.PrivateKey:
+		return signature.LoadED25519SignerVerifier(k)
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", errorInvalidSigningKey, priv)
+	}
+}
+
+// SignStatement wraps an in-toto statement in a DSSE envelope
+// signed by the signer.
+// Spec: https://github.com/secure-systems-lab/dsse/blob/master/envelope.md
+func SignStatement(statement []byte, signer signature.Signer) ([]byte, error) {
+	var header intoto.StatementHeader
+	if err := json.Unmarshal(statement, &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidAttestationFormat, err)
+	}
+	if header.Type != intoto.StatementInTotoV01 {
+		return nil, fmt.Errorf("%w: not an in-toto statement: %q", errorInvalidAttestationFormat, header.Type)
+	}
+
+	envelope, err := dsse.WrapSigner(signer, intoto.PayloadType).SignMessage(bytes.NewReader(statement))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorSigningFailed, err)
+	}
+	return envelope, nil
+}
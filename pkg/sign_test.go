@@ -0,0 +1,285 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	sigdsse "github.com/sigstore/sigstore/pkg/signature/dsse"
+)
+
+// pemKey returns the PKCS #8 PEM encoding of a private key.
+func pemKey(t *testing.T, priv crypto.PrivateKey) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKCS8PrivateKey: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypePrivateKey, Bytes: der})
+}
+
+// newTestSigner returns an ECDSA P-256 signer.
+func newTestSigner(t *testing.T) signature.SignerVerifier {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	sv, err := LoadSigningKey(pemKey(t, priv), nil)
+	if err != nil {
+		t.Fatalf("LoadSigningKey: %v", err)
+	}
+	return sv
+}
+
+func Test_LoadSigningKey(t *testing.T) {
+	t.Parallel()
+
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(p256)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey: %v", err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+
+	password := []byte("passw0rd")
+	encrypted, _, err := cryptoutils.GeneratePEMEncodedECDSAKeyPair(elliptic.P256(),
+		func(bool) ([]byte, error) { return password, nil })
+	if err != nil {
+		t.Fatalf("cryptoutils.GeneratePEMEncodedECDSAKeyPair: %v", err)
+	}
+	// cosign uses the same encryption under its own PEM type.
+	block, _ := pem.Decode(encrypted)
+	cosignKey := pem.EncodeToMemory(&pem.Block{Type: pemTypeEncryptedCosignKey, Bytes: block.Bytes})
+
+	tests := []struct {
+		name     string
+		key      []byte
+		password []byte
+		err      error
+	}{
+		{
+			name: "ecdsa p256 pkcs8",
+			key:  pemKey(t, p256),
+		},
+		{
+			name: "ecdsa p256 sec1",
+			key:  pem.EncodeToMemory(&pem.Block{Type: pemTypeECPrivateKey, Bytes: sec1}),
+		},
+		{
+			name: "ed25519",
+			key:  pemKey(t, ed),
+		},
+		{
+			name:     "encrypted sigstore key",
+			key:      encrypted,
+			password: password,
+		},
+		{
+			name:     "encrypted cosign key",
+			key:      cosignKey,
+			password: password,
+		},
+		{
+			name:     "wrong password",
+			key:      cosignKey,
+			password: []byte("wrong"),
+			err:      errorInvalidSigningKey,
+		},
+		{
+			name: "missing password",
+			key:  cosignKey,
+			err:  errorInvalidSigningKey,
+		},
+		{
+			name: "ecdsa p384",
+			key:  pemKey(t, p384),
+			err:  errorInvalidSigningKey,
+		},
+		{
+			name: "rsa",
+			key:  pemKey(t, rsaKey),
+			err:  errorInvalidSigningKey,
+		},
+		{
+			name: "public key",
+			key:  pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("key")}),
+			err:  errorInvalidSigningKey,
+		},
+		{
+			name: "not pem",
+			key:  []byte("not a key"),
+			err:  errorInvalidSigningKey,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			sv, err := LoadSigningKey(tt.key, tt.password)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+
+			// The key signs envelopes that its public key verifies.
+			statement := []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`)
+			envelope, err := SignStatement(statement, sv)
+			if err != nil {
+				t.Fatalf("SignStatement: %v", err)
+			}
+			if err := sigdsse.WrapVerifier(sv).VerifySignature(bytes.NewReader(envelope), nil); err != nil {
+				t.Errorf("VerifySignature: %v", err)
+			}
+		})
+	}
+}
+
+func Test_SignStatement(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestSigner(t)
+
+	tests := []struct {
+		name      string
+		statement string
+		err       error
+	}{
+		{
+			name:      "statement",
+			statement: `{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://slsa.dev/provenance/v0.2"}`,
+		},
+		{
+			name:      "predicate",
+			statement: `{"buildType":"https://github.com/slsa-framework/slsa-github-generator-ko@v1"}`,
+			err:       errorInvalidAttestationFormat,
+		},
+		{
+			name:      "not json",
+			statement: `statement`,
+			err:       errorInvalidAttestationFormat,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			content, err := SignStatement([]byte(tt.statement), signer)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+
+			var envelope dsse.Envelope
+			if err := json.Unmarshal(content, &envelope); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			if envelope.PayloadType != "application/vnd.in-toto+json" {
+				t.Errorf(cmp.Diff(envelope.PayloadType, "application/vnd.in-toto+json"))
+			}
+			payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+			if err != nil {
+				t.Fatalf("base64.StdEncoding.DecodeString: %v", err)
+			}
+			if string(payload) != tt.statement {
+				t.Errorf(cmp.Diff(string(payload), tt.statement))
+			}
+			if len(envelope.Signatures) != 1 {
+				t.Errorf("expected one signature, got %d", len(envelope.Signatures))
+			}
+
+			// Tampering with the payload invalidates the signature.
+			envelope.Payload = base64.StdEncoding.EncodeToString([]byte(`{}`))
+			tampered, err := json.Marshal(envelope)
+			if err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+			if err := sigdsse.WrapVerifier(signer).VerifySignature(bytes.NewReader(tampered), nil); err == nil {
+				t.Errorf("expected tampered envelope to fail verification")
+			}
+		})
+	}
+}
+
+func Test_generateAttestations_signed(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	images := []Image{{Name: "ghcr.io/org/a", Digest: testDigest1}}
+	signer := newTestSigner(t)
+
+	opts, err := AttestationOptions{Format: FormatStatement, Signer: signer}.normalize()
+	if err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	attestations, err := generateAttestations(images, gh, []string{"ko", "publish"}, nil, testBuilder, opts)
+	if err != nil {
+		t.Fatalf("generateAttestations: %v", err)
+	}
+	if len(attestations) != 1 {
+		t.Fatalf("expected one attestation, got %d", len(attestations))
+	}
+	if err := sigdsse.WrapVerifier(signer).VerifySignature(bytes.NewReader(attestations[0].Content), nil); err != nil {
+		t.Errorf("VerifySignature: %v", err)
+	}
+
+	// Only statements are signed.
+	_, err = AttestationOptions{Format: FormatPredicate, Signer: signer}.normalize()
+	if !errCmp(err, errorInvalidAttestationFormat) {
+		t.Errorf(cmp.Diff(err, errorInvalidAttestationFormat))
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	intoto "github.com/in-toto/in-toto-golang/in_toto"
+	slsa "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v0.2"
+)
+
+var (
+	errorInvalidAttestationFormat = errors.New("invalid attestation format")
+	errorInvalidSLSAVersion       = errors.New("invalid SLSA version")
+)
+
+// AttestationFormat selects what the attestation files contain.
+type AttestationFormat string
+
+const (
+	// FormatPredicate is the bare SLSA provenance predicate,
+	// e.g., for `cosign attest --predicate`.
+	FormatPredicate AttestationFormat = "predicate"
+	// FormatStatement is an in-toto v0.1 statement whose subjects
+	// are the images and whose predicate is the SLSA provenance.
+	FormatStatement AttestationFormat = "statement"
+)
+
+// ParseAttestationFormat parses the name of an attestation format.
+// An empty name selects FormatPredicate.
+func ParseAttestationFormat(format string) (AttestationFormat, error) {
+	switch AttestationFormat(format) {
+	case "", FormatPredicate:
+		return FormatPredicate, nil
+	case FormatStatement:
+		return FormatStatement, nil
+	default:
+		return "", fmt.Errorf("%w: %s", errorInvalidAttestationFormat, format)
+	}
+}
+
+// SLSAVersion selects the version of the SLSA provenance format.
+type SLSAVersion string
+
+const (
+	// SLSAVersion02 is https://slsa.dev/provenance/v0.2.
+	SLSAVersion02 SLSAVersion = "0.2"
+	// SLSAVersion10 is https://slsa.dev/provenance/v1.
+	SLSAVersion10 SLSAVersion = "1.0"
+)
+
+// ParseSLSAVersion parses a SLSA provenance version.
+// An empty version selects SLSAVersion02.
+func ParseSLSAVersion(version string) (SLSAVersion, error) {
+	switch SLSAVersion(version) {
+	case "", SLSAVersion02:
+		return SLSAVersion02, nil
+	case SLSAVersion10, "1":
+		return SLSAVersion10, nil
+	default:
+		return "", fmt.Errorf("%w: %s", errorInvalidSLSAVersion, version)
+	}
+}
+
+// provenance is a SLSA provenance predicate and its type.
+type provenance struct {
+	predicateType string
+	predicate     interface{}
+}
+
+// buildInputs are the inputs of the build recorded in the
+// provenance, besides the source and the builder.
+type buildInputs struct {
+	// modules are the Go module dependencies of the source.
+	modules []goModule
+	// baseImages are the images the binaries of all the import paths
+	// of the invocation are layered onto. ko's output does not tell
+	// which import path an image is built from, so the provenance of
+	// each image records all of them.
+	baseImages []baseImage
+	// koConfig is the ko configuration file, if any.
+	koConfig *KoConfigFile
+	// platforms are the platforms the subjects are built for,
+	// as returned by builtPlatforms.
+	platforms []string
+}
+
+func generateProvenance(gh *gitHubContext, com, env []string,
+	builder BuilderInfo, inputs buildInputs, version SLSAVersion) (*provenance, error) {
+	switch version {
+	case SLSAVersion02:
+		return &provenance{
+			predicateType: slsa.PredicateSLSAProvenance,
+			predicate:     generatePredicate(gh, com, env, builder, inputs),
+		}, nil
+	case SLSAVersion10:
+		return &provenance{
+			predicateType: predicateSLSAProvenanceV1,
+			predicate:     generatePredicateV1(gh, com, env, builder, inputs),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errorInvalidSLSAVersion, version)
+	}
+}
+
+// marshallAttestation serializes the predicate,
+// wrapped in a statement for the images if requested.
+func marshallAttestation(images []Image, p *provenance,
+	format AttestationFormat) ([]byte, error) {
+	switch format {
+	case FormatPredicate:
+		return json.Marshal(p.predicate)
+	case FormatStatement:
+		return json.Marshal(generateStatement(images, p))
+	default:
+		return nil, fmt.Errorf("%w: %s", errorInvalidAttestationFormat, format)
+	}
+}
+
+func generateStatement(images []Image, p *provenance) *intoto.Statement {
+	subjects := make([]intoto.Subject, 0, len(images))
+	for _, image := range images {
+		subjects = append(subjects, intoto.Subject{
+			Name: image.Name,
+			Digest: slsa.DigestSet{
+				"sha256": image.Digest,
+			},
+		})
+		// The image of each platform is a subject too, since
+		// clients pull the one of their platform by digest.
+		for _, m := range image.Manifests {
+			subjects = append(subjects, intoto.Subject{
+				Name: image.Name,
+				Digest: slsa.DigestSet{
+					"sha256": m.Digest,
+				},
+			})
+		}
+	}
+
+	return &intoto.Statement{
+		StatementHeader: intoto.StatementHeader{
+			Type:          intoto.StatementInTotoV01,
+			PredicateType: p.predicateType,
+			Subject:       subjects,
+		},
+		Predicate: p.predicate,
+	}
+}
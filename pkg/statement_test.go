@@ -0,0 +1,290 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	intoto "github.com/in-toto/in-toto-golang/in_toto"
+	slsa "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v0.2"
+)
+
+func Test_marshallAttestation(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	p, err := generateProvenance(gh, []string{"ko", "publish"}, []string{"GOOS=linux"},
+		testBuilder, buildInputs{}, SLSAVersion02)
+	if err != nil {
+		t.Fatalf("generateProvenance: %v", err)
+	}
+	predicate := p.predicate.(*slsa.ProvenancePredicate)
+
+	images := []Image{
+		{Name: "ghcr.io/org/a", Digest: testDigest1},
+		{
+			Name:   "ghcr.io/org/b",
+			Digest: testDigest2,
+			Manifests: []ImageManifest{
+				{Platform: "linux/amd64", Digest: testDigest3},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		format   AttestationFormat
+		expected intoto.StatementHeader
+		err      error
+	}{
+		{
+			name:   "predicate",
+			format: FormatPredicate,
+		},
+		{
+			name:   "statement",
+			format: FormatStatement,
+			expected: intoto.StatementHeader{
+				Type:          "https://in-toto.io/Statement/v0.1",
+				PredicateType: "https://slsa.dev/provenance/v0.2",
+				Subject: []intoto.Subject{
+					{Name: "ghcr.io/org/a", Digest: slsa.DigestSet{"sha256": testDigest1}},
+					{Name: "ghcr.io/org/b", Digest: slsa.DigestSet{"sha256": testDigest2}},
+					{Name: "ghcr.io/org/b", Digest: slsa.DigestSet{"sha256": testDigest3}},
+				},
+			},
+		},
+		{
+			name:   "invalid format",
+			format: "envelope",
+			err:    errorInvalidAttestationFormat,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			content, err := marshallAttestation(images, p, tt.format)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+
+			var statement struct {
+				intoto.StatementHeader
+				Predicate *slsa.ProvenancePredicate `json:"predicate"`
+			}
+			if err := json.Unmarshal(content, &statement); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			if !cmp.Equal(statement.StatementHeader, tt.expected) {
+				t.Errorf(cmp.Diff(statement.StatementHeader, tt.expected))
+			}
+
+			// The predicate is either at the top level or in the statement.
+			var got slsa.ProvenancePredicate
+			if tt.format == FormatStatement {
+				got = *statement.Predicate
+			} else if err := json.Unmarshal(content, &got); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			if got.Builder.ID != predicate.Builder.ID || got.BuildType != predicate.BuildType {
+				t.Errorf("unexpected predicate: %+v", got)
+			}
+		})
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// testInputs are the build inputs in the provenance of tests.
+var testInputs = buildInputs{
+	modules: []goModule{
+		{
+			Path:    "github.com/google/go-cmp",
+			Version: "v0.5.7",
+			Hash:    "0d7a3d6e1e4c3c1b0f5e8d7f8b9a6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b",
+		},
+		{
+			Path:    "golang.org/x/sys",
+			Version: "v0.0.0-20220412211240-33da011f77ad",
+			Hash:    "c1f3e4d5a6b7c8d9e0f1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f7",
+		},
+	},
+	baseImages: []baseImage{
+		{
+			Name:   "gcr.io/distroless/static",
+			Digest: "9b60270ec0991bc4f14bda475e8cae75594d8197d0ae58576ace84694aa75d7a",
+		},
+	},
+	koConfig: &KoConfigFile{
+		Path: ".ko.yaml",
+		Digest: map[string]string{
+			"sha256": "4e3b1d0a7c5f2e9b8d6a1c3f5e7b9d2a4c6e8f0a1b3d5c7e9f2a4b6d8c0e1f3a",
+		},
+		Config: KoConfig{
+			Builds: []KoBuildConfig{
+				{
+					ID:      "app",
+					Main:    "./cmd/app",
+					Env:     stringArray{"CGO_ENABLED=0"},
+					Flags:   stringArray{"-trimpath"},
+					Ldflags: stringArray{"-s -w", "-X main.version={{ .Git.Tag }}"},
+				},
+			},
+		},
+		ExpandedLdflags: []ExpandedLdflag{
+			{
+				Build:    0,
+				Template: "-X main.version={{ .Git.Tag }}",
+				Value:    "-X main.version=v1.2.3",
+			},
+		},
+	},
+	platforms: []string{"linux/amd64", "linux/arm64"},
+}
+
+func Test_generateProvenance(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	com := []string{"ko", "publish", "--tags=v1.2.3", "./cmd/app"}
+	env := []string{"GOFLAGS=-trimpath", "KO_DOCKER_REPO=ghcr.io/org"}
+
+	tests := []struct {
+		name          string
+		version       SLSAVersion
+		predicateType string
+		golden        string
+		err           error
+	}{
+		{
+			name:          "v0.2",
+			version:       SLSAVersion02,
+			predicateType: "https://slsa.dev/provenance/v0.2",
+			golden:        "predicate_v0.2.golden.json",
+		},
+		{
+			name:          "v1.0",
+			version:       SLSAVersion10,
+			predicateType: "https://slsa.dev/provenance/v1",
+			golden:        "predicate_v1.0.golden.json",
+		},
+		{
+			name:    "invalid version",
+			version: "0.1",
+			err:     errorInvalidSLSAVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := generateProvenance(gh, com, env, testBuilder, testInputs, tt.version)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+
+			if p.predicateType != tt.predicateType {
+				t.Errorf(cmp.Diff(p.predicateType, tt.predicateType))
+			}
+
+			content, err := json.MarshalIndent(p.predicate, "", "  ")
+			if err != nil {
+				t.Fatalf("json.MarshalIndent: %v", err)
+			}
+			content = append(content, '\n')
+
+			golden := filepath.Join("testdata", tt.golden)
+			if *updateGolden {
+				if err := os.WriteFile(golden, content, 0o600); err != nil {
+					t.Fatalf("os.WriteFile: %v", err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("os.ReadFile: %v", err)
+			}
+			if string(content) != string(expected) {
+				t.Errorf(cmp.Diff(string(content), string(expected)))
+			}
+		})
+	}
+}
+
+func Test_workflowPath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		repository  string
+		workflowRef string
+		expected    string
+	}{
+		{
+			name:        "tag",
+			repository:  "org/repo",
+			workflowRef: "org/repo/.github/workflows/release.yml@refs/tags/v1.2.3",
+			expected:    ".github/workflows/release.yml",
+		},
+		{
+			name:        "no ref",
+			repository:  "org/repo",
+			workflowRef: "org/repo/.github/workflows/release.yml",
+			expected:    ".github/workflows/release.yml",
+		},
+		{
+			name:       "no workflow ref",
+			repository: "org/repo",
+		},
+		{
+			name:        "other repository",
+			repository:  "org/repo",
+			workflowRef: "org/other/.github/workflows/release.yml@refs/heads/main",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			gh := &gitHubContext{Repository: tt.repository, WorkflowRef: tt.workflowRef}
+			if path := workflowPath(gh); path != tt.expected {
+				t.Errorf(cmp.Diff(path, tt.expected))
+			}
+		})
+	}
+}
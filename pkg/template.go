@@ -0,0 +1,109 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var errorInvalidTemplate = errors.New("invalid template")
+
+// templateData is the data templates are expanded with. It is read from
+// the trusted GitHub context, rather than from the env variables
+// or the git checkout, which callers control.
+type templateData struct {
+	// Env holds the GITHUB_* variables of the run.
+	Env map[string]string
+	Git gitTemplateData
+	// Date is the time of the build, in RFC 3339 format.
+	Date string
+}
+
+type gitTemplateData struct {
+	// Branch is the branch name if the run's ref is a branch.
+	Branch string
+	// Tag is the tag name if the run's ref is a tag.
+	Tag         string
+	Commit      string
+	ShortCommit string
+}
+
+func newTemplateData(gh *gitHubContext, now time.Time) templateData {
+	refName := gh.Ref
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/pull/"} {
+		if strings.HasPrefix(gh.Ref, prefix) {
+			refName = strings.TrimPrefix(gh.Ref, prefix)
+			break
+		}
+	}
+
+	git := gitTemplateData{
+		Commit:      gh.SHA,
+		ShortCommit: gh.SHA,
+	}
+	if len(gh.SHA) > 7 {
+		git.ShortCommit = gh.SHA[:7]
+	}
+	switch {
+	case strings.HasPrefix(gh.Ref, "refs/heads/"):
+		git.Branch = refName
+	case strings.HasPrefix(gh.Ref, "refs/tags/"):
+		git.Tag = refName
+	}
+
+	return templateData{
+		Env: map[string]string{
+			"GITHUB_ACTOR":       gh.Actor,
+			"GITHUB_BASE_REF":    gh.BaseRef,
+			"GITHUB_EVENT_NAME":  gh.EventName,
+			"GITHUB_HEAD_REF":    gh.HeadRef,
+			"GITHUB_REF":         gh.Ref,
+			"GITHUB_REF_NAME":    refName,
+			"GITHUB_REF_TYPE":    gh.RefType,
+			"GITHUB_REPOSITORY":  gh.Repository,
+			"GITHUB_RUN_ATTEMPT": gh.RunAttempt,
+			"GITHUB_RUN_ID":      gh.RunID,
+			"GITHUB_RUN_NUMBER":  gh.RunNumber,
+			"GITHUB_SERVER_URL":  gh.ServerUrl,
+			"GITHUB_SHA":         gh.SHA,
+			"GITHUB_WORKFLOW":    gh.Workflow,
+		},
+		Git:  git,
+		Date: now.UTC().Format(time.RFC3339),
+	}
+}
+
+// isTemplate reports whether s contains template actions.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// expand expands the template s. Unknown env variables are an error,
+// since ko would otherwise read them from its environment.
+func (d templateData) expand(s string) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errorInvalidTemplate, err)
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, d); err != nil {
+		return "", fmt.Errorf("%w: %v", errorInvalidTemplate, err)
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,107 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_templateData_expand(t *testing.T) {
+	t.Parallel()
+
+	tag, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	branch := *tag
+	branch.RefType = "branch"
+	branch.Ref = "refs/heads/release/v1"
+	now := time.Date(2022, 4, 12, 21, 12, 40, 0, time.FixedZone("", 2*60*60))
+
+	tests := []struct {
+		name     string
+		gh       *gitHubContext
+		template string
+		expected string
+		err      error
+	}{
+		{
+			name:     "tag",
+			gh:       tag,
+			template: "-X main.version={{ .Git.Tag }} -X main.commit={{ .Git.ShortCommit }}",
+			expected: "-X main.version=v1.2.3 -X main.commit=b54fb2e",
+		},
+		{
+			name:     "branch",
+			gh:       &branch,
+			template: "-X main.branch={{ .Git.Branch }} -X main.tag={{ .Git.Tag }}",
+			expected: "-X main.branch=release/v1 -X main.tag=",
+		},
+		{
+			name:     "env",
+			gh:       tag,
+			template: "-X main.ref={{ .Env.GITHUB_REF_NAME }} -X main.run={{ .Env.GITHUB_RUN_ID }}",
+			expected: "-X main.ref=v1.2.3 -X main.run=1234567890",
+		},
+		{
+			name:     "commit and date",
+			gh:       tag,
+			template: "-X main.commit={{ .Git.Commit }} -X main.date={{ .Date }}",
+			expected: "-X main.commit=b54fb2ec8807e9e4b1e8c0f6b2a9e1a8d7c6b5a4 -X main.date=2022-04-12T19:12:40Z",
+		},
+		{
+			name:     "not a template",
+			gh:       tag,
+			template: "-s -w",
+			expected: "-s -w",
+		},
+		{
+			name:     "unknown env variable",
+			gh:       tag,
+			template: "-X main.home={{ .Env.HOME }}",
+			err:      errorInvalidTemplate,
+		},
+		{
+			name:     "unknown field",
+			gh:       tag,
+			template: "-X main.version={{ .Version }}",
+			err:      errorInvalidTemplate,
+		},
+		{
+			name:     "syntax error",
+			gh:       tag,
+			template: "-X main.version={{ .Git.Tag }",
+			err:      errorInvalidTemplate,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			value, err := newTemplateData(tt.gh, now).expand(tt.template)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if value != tt.expected {
+				t.Errorf(cmp.Diff(value, tt.expected))
+			}
+		})
+	}
+}
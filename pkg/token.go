@@ -0,0 +1,250 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+var (
+	errorTokenFailed  = errors.New("OIDC token request failed")
+	errorInvalidToken = errors.New("invalid OIDC token")
+)
+
+// defaultGitHubIssuer issues the OIDC tokens of GitHub Actions.
+const defaultGitHubIssuer = "https://token.actions.githubusercontent.com"
+
+// TokenProvider issues OIDC tokens that identify the workflow run.
+type TokenProvider interface {
+	// Token returns a JWT for the audience.
+	Token(audience string) (string, error)
+}
+
+// gitHubTokenProvider requests tokens from the GitHub Actions runtime.
+// See https://docs.github.com/en/actions/deployment/security-hardening-your-deployments/about-security-hardening-with-openid-connect.
+type gitHubTokenProvider struct {
+	url          string
+	requestToken string
+	client       *http.Client
+}
+
+// NewGitHubTokenProvider returns a provider of the tokens of the
+// GitHub Actions runtime, which requires the `id-token: write`
+// permission.
+func NewGitHubTokenProvider() TokenProvider {
+	return newGitHubTokenProvider(os.Getenv(requestURLEnvKey), os.Getenv(requestTokenEnvKey))
+}
+
+func newGitHubTokenProvider(url, requestToken string) *gitHubTokenProvider {
+	return &gitHubTokenProvider{
+		url:          url,
+		requestToken: requestToken,
+		client:       http.DefaultClient,
+	}
+}
+
+func (p *gitHubTokenProvider) Token(audience string) (string, error) {
+	if p.url == "" {
+		return "", fmt.Errorf("%w: %s is empty", errorTokenFailed, requestURLEnvKey)
+	}
+
+	req, err := http.NewRequest("GET", p.url+"&audience="+url.QueryEscape(audience), nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errorTokenFailed, err)
+	}
+	req.Header.Add("Authorization", "bearer "+p.requestToken)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errorTokenFailed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("%w: %s: %s", errorTokenFailed, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var payload struct {
+		Value string `json:"value"`
+	}
+
+	// Extract the value from JSON payload.
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&payload); err != nil {
+		return "", fmt.Errorf("%w: %v", errorTokenFailed, err)
+	}
+	if payload.Value == "" {
+		return "", fmt.Errorf("%w: empty token", errorTokenFailed)
+	}
+
+	return payload.Value, nil
+}
+
+// fileTokenProvider reads a token from a file.
+type fileTokenProvider struct {
+	path string
+}
+
+// NewFileTokenProvider returns a provider of the JWT stored in the
+// file, e.g., one issued out of band. The file is read for each token,
+// so that it can be refreshed. The audience is not checked: the token
+// must be valid for the audiences it is used for. Since the builder ID
+// and Fulcio each require their own single audience, the same file
+// cannot serve both.
+func NewFileTokenProvider(path string) TokenProvider {
+	return &fileTokenProvider{path: path}
+}
+
+func (p *fileTokenProvider) Token(audience string) (string, error) {
+	content, err := os.ReadFile(p.path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errorTokenFailed, err)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("%w: %s is empty", errorTokenFailed, p.path)
+	}
+	return token, nil
+}
+
+// TokenVerifier checks the signature and the claims of OIDC tokens
+// with the keys of their issuer.
+type TokenVerifier struct {
+	issuer string
+
+	// keys are loaded from the issuer when first needed, then cached.
+	mu   sync.Mutex
+	keys oidc.KeySet
+}
+
+// NewTokenVerifier returns a verifier of the tokens of the issuer,
+// or of GitHub Actions if issuer is empty. The issuer's keys are
+// fetched from the JWKS its discovery document points to.
+func NewTokenVerifier(issuer string) *TokenVerifier {
+	if issuer == "" {
+		issuer = defaultGitHubIssuer
+	}
+	return &TokenVerifier{issuer: strings.TrimSuffix(issuer, "/")}
+}
+
+// NewTokenVerifierFromJWKSFile returns a verifier of the tokens of the
+// issuer, or of GitHub Actions if issuer is empty, whose keys are
+// read from a local JWKS file, e.g., when offline.
+func NewTokenVerifierFromJWKSFile(issuer, path string) (*TokenVerifier, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidToken, err)
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errorInvalidToken, path, err)
+	}
+	if len(jwks.Keys) == 0 {
+		return nil, fmt.Errorf("%w: %s: no key", errorInvalidToken, path)
+	}
+
+	v := NewTokenVerifier(issuer)
+	v.keys = &jwksKeySet{jwks: jwks}
+	return v, nil
+}
+
+func (v *TokenVerifier) keySet(ctx context.Context) (oidc.KeySet, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.keys != nil {
+		return v.keys, nil
+	}
+
+	// The provider checks that the discovery document is the issuer's.
+	provider, err := oidc.NewProvider(ctx, v.issuer)
+	if err != nil {
+		return nil, err
+	}
+	var discovery struct {
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return nil, err
+	}
+	// The remote key set caches the keys and refreshes them
+	// when a token is signed by an unknown key.
+	v.keys = oidc.NewRemoteKeySet(context.Background(), discovery.JWKSURL)
+	return v.keys, nil
+}
+
+// Verify checks that the token is signed by the issuer, is issued for
+// the audience alone, and is valid now, i.e., checks its signature and
+// its `iss`, `aud`, `exp` and `nbf` claims, then decodes its claims
+// into claims.
+func (v *TokenVerifier) Verify(token, audience string, claims interface{}) error {
+	ctx := context.Background()
+	keys, err := v.keySet(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errorInvalidToken, err)
+	}
+
+	idToken, err := oidc.NewVerifier(v.issuer, keys, &oidc.Config{ClientID: audience}).Verify(ctx, token)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errorInvalidToken, err)
+	}
+	if len(idToken.Audience) != 1 {
+		return fmt.Errorf("%w: unexpected audiences %q", errorInvalidToken, idToken.Audience)
+	}
+
+	if err := idToken.Claims(claims); err != nil {
+		return fmt.Errorf("%w: %v", errorInvalidToken, err)
+	}
+	return nil
+}
+
+// jwksKeySet verifies signatures with the keys of a JWKS.
+type jwksKeySet struct {
+	jwks jose.JSONWebKeySet
+}
+
+func (s *jwksKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens without a key ID are tried with all the keys.
+	var keys []jose.JSONWebKey
+	if len(jws.Signatures) == 1 && jws.Signatures[0].Header.KeyID != "" {
+		keys = s.jwks.Key(jws.Signatures[0].Header.KeyID)
+	} else {
+		keys = s.jwks.Keys
+	}
+	for _, key := range keys {
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("no key verifies the signature")
+}
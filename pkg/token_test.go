@@ -0,0 +1,447 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const testRequestToken = "request-token"
+
+// newTestTokenServer serves the token for any audience in place
+// of GitHub's token endpoint, to requests with testRequestToken.
+func newTestTokenServer(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "bearer "+testRequestToken {
+			http.Error(w, "invalid request token", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("api-version") == "" || r.URL.Query().Get("audience") == "" {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"value": %q}`, token)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newTestTokenProvider returns a GitHub token provider
+// backed by a test server that serves the token.
+func newTestTokenProvider(t *testing.T, token string) TokenProvider {
+	t.Helper()
+
+	s := newTestTokenServer(t, token)
+	return newGitHubTokenProvider(s.URL+"?api-version=2.0", testRequestToken)
+}
+
+// testIssuer is an OIDC issuer that serves its discovery
+// document and JWKS, and signs tokens with its RSA key.
+type testIssuer struct {
+	url    string
+	jwks   jose.JSONWebKeySet
+	signer jose.Signer
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: key, KeyID: "test"},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatalf("jose.NewSigner: %v", err)
+	}
+	i := &testIssuer{
+		jwks: jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: key.Public(), KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}},
+		signer: signer,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                i.url,
+			"jwks_uri":                              i.url + "/.well-known/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/.well-known/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(i.jwks)
+	})
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	i.url = s.URL
+	return i
+}
+
+// token signs the claims, completed with the issuer,
+// the builder's audience and a validity of one hour.
+func (i *testIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	now := time.Now().Unix()
+	c := map[string]interface{}{
+		"iss": i.url,
+		"aud": audience,
+		"iat": now,
+		"nbf": now,
+		"exp": now + 3600,
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	jws, err := i.signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatalf("CompactSerialize: %v", err)
+	}
+	return token
+}
+
+// workflowToken returns a token of the workflow run by the builder.
+func (i *testIssuer) workflowToken(t *testing.T, jobWorkflowRef string) string {
+	t.Helper()
+
+	return i.token(t, map[string]interface{}{
+		"sub":              "repo:org/repo:ref:refs/tags/v1.2.3",
+		"job_workflow_ref": jobWorkflowRef,
+	})
+}
+
+// writeJWKS writes the issuer's JWKS to a file.
+func (i *testIssuer) writeJWKS(t *testing.T) string {
+	t.Helper()
+
+	content, err := json.Marshal(i.jwks)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func Test_gitHubTokenProvider(t *testing.T) {
+	t.Parallel()
+
+	token := testJWT(t, map[string]string{"job_workflow_ref": testJobWorkflowRef})
+	s := newTestTokenServer(t, token)
+
+	tests := []struct {
+		name         string
+		url          string
+		requestToken string
+		expected     string
+		err          error
+	}{
+		{
+			name:         "token",
+			url:          s.URL + "?api-version=2.0",
+			requestToken: testRequestToken,
+			expected:     token,
+		},
+		{
+			name:         "invalid request token",
+			url:          s.URL + "?api-version=2.0",
+			requestToken: "other",
+			err:          errorTokenFailed,
+		},
+		{
+			name:         "no url",
+			requestToken: testRequestToken,
+			err:          errorTokenFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			token, err := newGitHubTokenProvider(tt.url, tt.requestToken).Token(audience)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if token != tt.expected {
+				t.Errorf(cmp.Diff(token, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_fileTokenProvider(t *testing.T) {
+	t.Parallel()
+
+	token := testJWT(t, map[string]string{"job_workflow_ref": testJobWorkflowRef})
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+		err      error
+	}{
+		{
+			name:     "token",
+			path:     write("token", token+"\n"),
+			expected: token,
+		},
+		{
+			name: "empty file",
+			path: write("empty", "\n"),
+			err:  errorTokenFailed,
+		},
+		{
+			name: "no file",
+			path: filepath.Join(dir, "missing"),
+			err:  errorTokenFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			token, err := NewFileTokenProvider(tt.path).Token(audience)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if token != tt.expected {
+				t.Errorf(cmp.Diff(token, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_TokenVerifier(t *testing.T) {
+	t.Parallel()
+
+	issuer := newTestIssuer(t)
+	other := newTestIssuer(t)
+	fromFile, err := NewTokenVerifierFromJWKSFile(issuer.url, issuer.writeJWKS(t))
+	if err != nil {
+		t.Fatalf("NewTokenVerifierFromJWKSFile: %v", err)
+	}
+	verifiers := map[string]*TokenVerifier{
+		"remote": NewTokenVerifier(issuer.url),
+		"file":   fromFile,
+	}
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{
+			name:  "valid",
+			token: issuer.token(t, map[string]interface{}{"job_workflow_ref": testJobWorkflowRef}),
+		},
+		{
+			name: "signed by another issuer",
+			token: other.token(t, map[string]interface{}{
+				"iss":              issuer.url,
+				"job_workflow_ref": testJobWorkflowRef,
+			}),
+			err: errorInvalidToken,
+		},
+		{
+			name:  "unsigned",
+			token: testJWT(t, map[string]string{"iss": issuer.url, "aud": audience}),
+			err:   errorInvalidToken,
+		},
+		{
+			name:  "other issuer",
+			token: issuer.token(t, map[string]interface{}{"iss": other.url}),
+			err:   errorInvalidToken,
+		},
+		{
+			name:  "other audience",
+			token: issuer.token(t, map[string]interface{}{"aud": defaultOIDCClientID}),
+			err:   errorInvalidToken,
+		},
+		{
+			name:  "several audiences",
+			token: issuer.token(t, map[string]interface{}{"aud": []string{audience, defaultOIDCClientID}}),
+			err:   errorInvalidToken,
+		},
+		{
+			name:  "expired",
+			token: issuer.token(t, map[string]interface{}{"iat": now - 7200, "nbf": now - 7200, "exp": now - 3600}),
+			err:   errorInvalidToken,
+		},
+		{
+			name:  "not yet valid",
+			token: issuer.token(t, map[string]interface{}{"nbf": now + 1800}),
+			err:   errorInvalidToken,
+		},
+	}
+
+	for name, verifier := range verifiers {
+		verifier := verifier
+		for _, tt := range tests {
+			tt := tt // Re-initializing variable so it is not changed while executing the closure below
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				t.Parallel()
+
+				var claims struct {
+					JobWorkflowRef string `json:"job_workflow_ref"`
+				}
+				err := verifier.Verify(tt.token, audience, &claims)
+				if !errCmp(err, tt.err) {
+					t.Fatalf(cmp.Diff(err, tt.err))
+				}
+				if err == nil && claims.JobWorkflowRef != testJobWorkflowRef {
+					t.Errorf(cmp.Diff(claims.JobWorkflowRef, testJobWorkflowRef))
+				}
+			})
+		}
+	}
+
+	// The issuer's keys are required.
+	_, err = NewTokenVerifierFromJWKSFile(issuer.url, filepath.Join(t.TempDir(), "missing"))
+	if !errCmp(err, errorInvalidToken) {
+		t.Errorf(cmp.Diff(err, errorInvalidToken))
+	}
+	err = NewTokenVerifier(issuer.url+"/other").Verify(issuer.token(t, nil), audience, &struct{}{})
+	if !errCmp(err, errorInvalidToken) {
+		t.Errorf(cmp.Diff(err, errorInvalidToken))
+	}
+}
+
+func Test_getReusableWorkflowID(t *testing.T) {
+	t.Parallel()
+
+	issuer := newTestIssuer(t)
+	verifier := NewTokenVerifier(issuer.url)
+
+	tests := []struct {
+		name     string
+		tokens   TokenProvider
+		expected string
+		err      error
+	}{
+		{
+			name:     "job workflow ref",
+			tokens:   newTestTokenProvider(t, issuer.workflowToken(t, testJobWorkflowRef)),
+			expected: testJobWorkflowRef,
+		},
+		{
+			name:   "no job workflow ref",
+			tokens: newTestTokenProvider(t, issuer.workflowToken(t, "")),
+			err:    errorInvalidToken,
+		},
+		{
+			name:   "unverified token",
+			tokens: newTestTokenProvider(t, testJWT(t, map[string]string{"job_workflow_ref": testJobWorkflowRef})),
+			err:    errorInvalidToken,
+		},
+		{
+			name:   "token request failure",
+			tokens: newGitHubTokenProvider("", ""),
+			err:    errorTokenFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			id, err := getReusableWorkflowID(tt.tokens, verifier)
+			if !errCmp(err, tt.err) {
+				t.Errorf(cmp.Diff(err, tt.err))
+			}
+			if id != tt.expected {
+				t.Errorf(cmp.Diff(id, tt.expected))
+			}
+		})
+	}
+}
+
+func Test_GeneratePredicates_builderID(t *testing.T) {
+	t.Parallel()
+
+	issuer := newTestIssuer(t)
+	host := newTestRegistry(t)
+	images := []Image{pushRandomImage(t, host+"/org/a")}
+	attestations, err := generatePredicates(images, testGitHubContext, "", "", AttestationOptions{
+		Format:        FormatStatement,
+		Tokens:        newTestTokenProvider(t, issuer.workflowToken(t, testJobWorkflowRef)),
+		TokenVerifier: NewTokenVerifier(issuer.url),
+	})
+	if err != nil {
+		t.Fatalf("GeneratePredicates: %v", err)
+	}
+
+	var statement statementV01
+	if err := json.Unmarshal(attestations[0].Content, &statement); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	summary, err := summarizeProvenance(&statement)
+	if err != nil {
+		t.Fatalf("summarizeProvenance: %v", err)
+	}
+	if expected := "https://github.com/" + testJobWorkflowRef; summary.builderID != expected {
+		t.Errorf(cmp.Diff(summary.builderID, expected))
+	}
+
+	// The builder ID is not read from tokens of another issuer.
+	_, err = generatePredicates(images, testGitHubContext, "", "", AttestationOptions{
+		Tokens:        newTestTokenProvider(t, newTestIssuer(t).workflowToken(t, testJobWorkflowRef)),
+		TokenVerifier: NewTokenVerifier(issuer.url),
+	})
+	if !errCmp(err, errorInvalidToken) {
+		t.Errorf(cmp.Diff(err, errorInvalidToken))
+	}
+}
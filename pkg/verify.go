@@ -0,0 +1,621 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	intoto "github.com/in-toto/in-toto-golang/in_toto"
+	slsa "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v0.2"
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	sigdsse "github.com/sigstore/sigstore/pkg/signature/dsse"
+)
+
+var (
+	errorInvalidVerifyOptions = errors.New("invalid verification options")
+	errorNoAttestation        = errors.New("no attestation found")
+)
+
+// Names of the checks of a verification.
+const (
+	CheckSignature    = "signature"
+	CheckSubject      = "subject"
+	CheckBuildType    = "buildType"
+	CheckBuilderID    = "builderID"
+	CheckConfigSource = "configSource"
+)
+
+// VerifyOptions are the expectations the provenance is checked against.
+type VerifyOptions struct {
+	// BuilderID is the expected reusable workflow ref, e.g.,
+	// org/builder/.github/workflows/builder.yml@refs/tags/v1.0.0.
+	BuilderID string
+	// SourceURI is the expected source repository, e.g., github.com/org/repo.
+	SourceURI string
+	// SourceRef is the expected git ref of the source, e.g., refs/tags/v1.2.3.
+	// Any ref is accepted if empty.
+	SourceRef string
+	// PublicKey verifies the signature of attestations signed with a key.
+	PublicKey crypto.PublicKey
+	// Roots verify the certificate of attestations signed keyless.
+	Roots *x509.CertPool
+	// Issuer is the expected OIDC issuer recorded in the certificate of
+	// attestations signed keyless. It defaults to GitHub Actions' issuer.
+	Issuer string
+	// RekorPublicKey verifies the Rekor bundles, which attestations
+	// signed keyless require. It defaults to the public instance's key.
+	RekorPublicKey *ecdsa.PublicKey
+}
+
+func (o VerifyOptions) validate() error {
+	if o.BuilderID == "" {
+		return fmt.Errorf("%w: the builder ID is required", errorInvalidVerifyOptions)
+	}
+	if o.SourceURI == "" {
+		return fmt.Errorf("%w: the source URI is required", errorInvalidVerifyOptions)
+	}
+	if o.PublicKey == nil && o.Roots == nil {
+		return fmt.Errorf("%w: a public key or certificate roots are required", errorInvalidVerifyOptions)
+	}
+	return nil
+}
+
+// LoadVerificationKeyFile reads a PEM-encoded public key.
+func LoadVerificationKeyFile(path string) (crypto.PublicKey, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidVerifyOptions, err)
+	}
+	publicKey, err := cryptoutils.UnmarshalPEMToPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errorInvalidVerifyOptions, path, err)
+	}
+	return publicKey, nil
+}
+
+// LoadCertificateRootsFile reads PEM-encoded root certificates,
+// e.g., those of Fulcio.
+func LoadCertificateRootsFile(path string) (*x509.CertPool, error) {
+	certs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errorInvalidVerifyOptions, err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certs) {
+		return nil, fmt.Errorf("%w: %s: no certificate", errorInvalidVerifyOptions, path)
+	}
+	return roots, nil
+}
+
+// CheckResult is the outcome of one check.
+type CheckResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Reason explains why the check failed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// VerificationResult is the outcome of the checks of one attestation.
+type VerificationResult struct {
+	// Source identifies the attestation, e.g., its file or registry location.
+	Source string        `json:"source"`
+	Passed bool          `json:"passed"`
+	Checks []CheckResult `json:"checks"`
+}
+
+func (r *VerificationResult) check(name string, err error) {
+	c := CheckResult{Name: name, Passed: err == nil}
+	if err != nil {
+		c.Reason = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// VerifyAttestation checks a DSSE envelope, as written by the predicate
+// and build-and-attest commands, about the image. The certificate is
+// the PEM-encoded certificate chain of keyless attestations, and the
+// bundle the JSON-encoded Rekor bundle, which keyless attestations
+// require.
+func VerifyAttestation(source string, content, certificate, bundle []byte,
+	image Image, opts VerifyOptions) (*VerificationResult, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return verifyAttestation(source, content, certificate, bundle, image, opts), nil
+}
+
+func verifyAttestation(source string, content, certificate, bundle []byte,
+	image Image, opts VerifyOptions) *VerificationResult {
+	res := &VerificationResult{Source: source}
+
+	statement, err := verifyEnvelope(content, certificate, bundle, opts)
+	res.check(CheckSignature, err)
+	if statement == nil {
+		return res
+	}
+
+	res.check(CheckSubject, verifySubject(statement, image))
+
+	summary, err := summarizeProvenance(statement)
+	if err != nil {
+		res.check(CheckBuildType, err)
+		return res
+	}
+	res.check(CheckBuildType, verifyBuildType(summary))
+	res.check(CheckBuilderID, verifyBuilderID(summary, opts))
+	res.check(CheckConfigSource, verifyConfigSource(summary, opts))
+
+	res.Passed = true
+	for _, c := range res.Checks {
+		res.Passed = res.Passed && c.Passed
+	}
+	return res
+}
+
+// statementV01 is an in-toto statement whose predicate is decoded
+// according to its type.
+type statementV01 struct {
+	intoto.StatementHeader
+	Predicate json.RawMessage `json:"predicate"`
+}
+
+// verifyEnvelope checks the signature of the envelope and returns its
+// statement. The statement of an envelope whose signature is invalid is
+// still returned, so that the other checks are reported.
+func verifyEnvelope(content, certificate, bundle []byte, opts VerifyOptions) (*statementV01, error) {
+	var envelope dsse.Envelope
+	if err := json.Unmarshal(content, &envelope); err != nil || envelope.PayloadType == "" {
+		// Unsigned statements are reported as such.
+		var statement statementV01
+		if err := json.Unmarshal(content, &statement); err == nil &&
+			statement.Type == intoto.StatementInTotoV01 {
+			return &statement, fmt.Errorf("the attestation is not signed")
+		}
+		return nil, fmt.Errorf("the attestation is not a DSSE envelope")
+	}
+	if envelope.PayloadType != intoto.PayloadType {
+		return nil, fmt.Errorf("unexpected payload type %q", envelope.PayloadType)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload: %v", err)
+	}
+	var statement statementV01
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, fmt.Errorf("invalid statement: %v", err)
+	}
+	if statement.Type != intoto.StatementInTotoV01 {
+		return nil, fmt.Errorf("unexpected statement type %q", statement.Type)
+	}
+
+	publicKey, err := signingPublicKey(content, certificate, bundle, opts)
+	if err != nil {
+		return &statement, err
+	}
+	verifier, err := signature.LoadVerifier(publicKey, crypto.SHA256)
+	if err != nil {
+		return &statement, err
+	}
+	if err := sigdsse.WrapVerifier(verifier).VerifySignature(bytes.NewReader(content), nil); err != nil {
+		return &statement, fmt.Errorf("invalid signature: %v", err)
+	}
+	return &statement, nil
+}
+
+// signingPublicKey returns the key of the certificate if it is
+// issued by the roots to the builder, or the public key. The envelope
+// must be in the log of the bundle, if any, which is required for
+// certificates: the certificate must have been valid when the envelope
+// was logged, since its key is not trusted afterwards.
+func signingPublicKey(envelope, certificate, bundle []byte, opts VerifyOptions) (crypto.PublicKey, error) {
+	var rekorBundle *RekorBundle
+	if bundle != nil {
+		rekorBundle = &RekorBundle{}
+		if err := json.Unmarshal(bundle, rekorBundle); err != nil {
+			return nil, fmt.Errorf("invalid rekor bundle: %v", err)
+		}
+		rekorKey, err := rekorPublicKey("", opts.RekorPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := rekorBundle.VerifySET(rekorKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if certificate == nil {
+		if opts.PublicKey == nil {
+			return nil, fmt.Errorf("the attestation has no certificate")
+		}
+		if rekorBundle != nil {
+			publicKey, err := cryptoutils.MarshalPublicKeyToPEM(opts.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+			if err := rekorBundle.checkEntry(envelope, publicKey); err != nil {
+				return nil, err
+			}
+		}
+		return opts.PublicKey, nil
+	}
+	if opts.Roots == nil {
+		return nil, fmt.Errorf("no certificate roots to verify the certificate")
+	}
+	if rekorBundle == nil {
+		return nil, fmt.Errorf("the keyless attestation has no rekor bundle")
+	}
+
+	certs, err := cryptoutils.UnmarshalCertificatesFromPEM(certificate)
+	if err != nil || len(certs) == 0 {
+		return nil, fmt.Errorf("invalid certificate: %v", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	leaf := certs[0]
+	if err := rekorBundle.checkIntegratedTime(leaf); err != nil {
+		return nil, err
+	}
+	leafPEM, err := cryptoutils.MarshalCertificateToPEM(leaf)
+	if err != nil {
+		return nil, err
+	}
+	if err := rekorBundle.checkEntry(envelope, leafPEM); err != nil {
+		return nil, err
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		// The certificate is short-lived: it is checked
+		// at the time the envelope was logged.
+		CurrentTime:   time.Unix(rekorBundle.Payload.IntegratedTime, 0),
+		Roots:         opts.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, fmt.Errorf("untrusted certificate: %v", err)
+	}
+
+	issuer := opts.Issuer
+	if issuer == "" {
+		issuer = defaultGitHubIssuer
+	}
+	if got, err := certificateIssuer(leaf); err != nil || got != issuer {
+		return nil, fmt.Errorf("the certificate is not issued for a token of %s: %q %v", issuer, got, err)
+	}
+
+	expected := builderURL(opts.BuilderID)
+	for _, uri := range leaf.URIs {
+		if uri.String() == expected {
+			return leaf.PublicKey, nil
+		}
+	}
+	return nil, fmt.Errorf("the certificate is not issued to %s: %v", expected, leaf.URIs)
+}
+
+var (
+	// oidFulcioIssuer is the extension of Fulcio certificates holding
+	// the issuer of the OIDC token as a raw string.
+	oidFulcioIssuer = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	// oidFulcioIssuerV2 holds the issuer as a DER-encoded UTF8String.
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// certificateIssuer returns the issuer of the OIDC token
+// the Fulcio certificate was issued for.
+func certificateIssuer(cert *x509.Certificate) (string, error) {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidFulcioIssuerV2):
+			var issuer string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &issuer, "utf8"); err != nil {
+				return "", err
+			}
+			return issuer, nil
+		case ext.Id.Equal(oidFulcioIssuer):
+			return string(ext.Value), nil
+		}
+	}
+	return "", errors.New("no issuer extension")
+}
+
+func verifySubject(statement *statementV01, image Image) error {
+	for _, s := range statement.Subject {
+		if s.Digest["sha256"] == image.Digest {
+			return nil
+		}
+	}
+	return fmt.Errorf("no subject has the digest sha256:%s", image.Digest)
+}
+
+// provenanceSummary holds the fields of the provenance
+// that are checked, whatever its version.
+type provenanceSummary struct {
+	buildType       string
+	builderID       string
+	configSourceURI string
+	// legacySourceURI is set for v0.2 provenance, whose config source
+	// URI joins the server URL and the repository without a separator,
+	// and ends with ".git".
+	legacySourceURI bool
+}
+
+// sourceRef returns the ref of the config source
+// if it is in the repository, e.g., github.com/org/repo.
+func (s *provenanceSummary) sourceRef(repository string) (string, bool) {
+	uri := s.configSourceURI
+	prefix := "git+https://" + repository + "@"
+	if s.legacySourceURI {
+		if !strings.HasSuffix(uri, ".git") {
+			return "", false
+		}
+		uri = strings.TrimSuffix(uri, ".git")
+		prefix = "git+https://" + strings.Replace(repository, "/", "", 1) + "@"
+	}
+	if !strings.HasPrefix(uri, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(uri, prefix), true
+}
+
+func summarizeProvenance(statement *statementV01) (*provenanceSummary, error) {
+	switch statement.PredicateType {
+	case slsa.PredicateSLSAProvenance:
+		var p slsa.ProvenancePredicate
+		if err := json.Unmarshal(statement.Predicate, &p); err != nil {
+			return nil, fmt.Errorf("invalid predicate: %v", err)
+		}
+		return &provenanceSummary{
+			buildType:       p.BuildType,
+			builderID:       p.Builder.ID,
+			configSourceURI: p.Invocation.ConfigSource.URI,
+			legacySourceURI: true,
+		}, nil
+
+	case predicateSLSAProvenanceV1:
+		var p ProvenanceV1
+		// The parameters are decoded according to the build type.
+		var params ExternalParametersV1
+		p.BuildDefinition.ExternalParameters = &params
+		if err := json.Unmarshal(statement.Predicate, &p); err != nil {
+			return nil, fmt.Errorf("invalid predicate: %v", err)
+		}
+		return &provenanceSummary{
+			buildType:       p.BuildDefinition.BuildType,
+			builderID:       p.RunDetails.Builder.ID,
+			configSourceURI: fmt.Sprintf("git+%s@%s", params.Workflow.Repository, params.Workflow.Ref),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported predicate type %q", statement.PredicateType)
+	}
+}
+
+func verifyBuildType(summary *provenanceSummary) error {
+	if summary.buildType != buildType {
+		return fmt.Errorf("build type %q is not %q", summary.buildType, buildType)
+	}
+	return nil
+}
+
+func verifyBuilderID(summary *provenanceSummary, opts VerifyOptions) error {
+	expected := builderURL(opts.BuilderID)
+	if summary.builderID != expected {
+		return fmt.Errorf("builder ID %q is not %q", summary.builderID, expected)
+	}
+	return nil
+}
+
+func verifyConfigSource(summary *provenanceSummary, opts VerifyOptions) error {
+	ref, ok := summary.sourceRef(strings.TrimPrefix(opts.SourceURI, "https://"))
+	if !ok {
+		return fmt.Errorf("config source %q is not from %q", summary.configSourceURI, opts.SourceURI)
+	}
+	if opts.SourceRef != "" && ref != opts.SourceRef {
+		return fmt.Errorf("config source %q is not at %q", summary.configSourceURI, opts.SourceRef)
+	}
+	return nil
+}
+
+// builderURL returns the builder ID as it appears in the provenance.
+func builderURL(id string) string {
+	if strings.HasPrefix(id, "https://") {
+		return id
+	}
+	return "https://github.com/" + id
+}
+
+// VerifyImage fetches the attestations attached to the image, as a
+// cosign `.att` tag or OCI 1.1 referrers, and checks each of them.
+// The image passes verification if one of its attestations does.
+func VerifyImage(ref string, opts VerifyOptions) ([]VerificationResult, error) {
+	return verifyImage(ref, opts, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+func verifyImage(ref string, opts VerifyOptions, remoteOpts ...remote.Option) ([]VerificationResult, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	digest, err := resolveDigest(ref, remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+	image := Image{Name: digest.Context().Name(), Digest: strings.TrimPrefix(digest.DigestStr(), "sha256:")}
+
+	attached, err := fetchAttachedAttestations(digest, remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(attached) == 0 {
+		return nil, fmt.Errorf("%w: %s", errorNoAttestation, image)
+	}
+
+	results := make([]VerificationResult, 0, len(attached))
+	for _, a := range attached {
+		results = append(results, *verifyAttestation(a.source, a.content, a.certificate, a.bundle, image, opts))
+	}
+	return results, nil
+}
+
+// resolveDigest returns the reference by digest of the image,
+// resolving its tag if needed.
+func resolveDigest(ref string, opts ...remote.Option) (name.Digest, error) {
+	if d, err := name.NewDigest(ref); err == nil {
+		return d, nil
+	}
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("%w: %s: %v", errorInvalidImage, ref, err)
+	}
+	desc, err := remote.Head(r, opts...)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("%w: %s: %v", errorInvalidImage, ref, err)
+	}
+	return r.Context().Digest(desc.Digest.String()), nil
+}
+
+// attachedAttestation is an attestation fetched from the registry.
+type attachedAttestation struct {
+	source      string
+	content     []byte
+	certificate []byte
+	bundle      []byte
+}
+
+// fetchAttachedAttestations returns the DSSE envelopes attached to the
+// image with attachCosign and attachReferrer.
+func fetchAttachedAttestations(ref name.Digest, opts ...remote.Option) ([]attachedAttestation, error) {
+	var res []attachedAttestation
+	tag := strings.Replace(ref.DigestStr(), ":", "-", 1)
+
+	// cosign's `.att` tag.
+	att := ref.Context().Tag(tag + ".att")
+	img, err := remote.Image(att, opts...)
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		return nil, err
+	default:
+		manifest, err := img.Manifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range manifest.Layers {
+			if l.MediaType != dsseEnvelopeMediaType {
+				continue
+			}
+			content, err := fetchBlob(ref, l.Digest.String(), opts...)
+			if err != nil {
+				return nil, err
+			}
+			a := attachedAttestation{
+				source:  fmt.Sprintf("%s@%s", att, l.Digest),
+				content: content,
+			}
+			if c, ok := l.Annotations[cosignCertificateAnnotation]; ok {
+				a.certificate = []byte(c + l.Annotations[cosignChainAnnotation])
+			}
+			if b, ok := l.Annotations[cosignBundleAnnotation]; ok {
+				a.bundle = []byte(b)
+			}
+			res = append(res, a)
+		}
+	}
+
+	// The referrers index.
+	desc, err := remote.Get(ref.Context().Tag(tag), opts...)
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		return nil, err
+	default:
+		var index ociIndex
+		if err := json.Unmarshal(desc.Manifest, &index); err != nil {
+			return nil, err
+		}
+		for _, m := range index.Manifests {
+			if m.ArtifactType != intoto.PayloadType {
+				continue
+			}
+			artifact, err := remote.Get(ref.Context().Digest(m.Digest.String()), opts...)
+			if err != nil {
+				return nil, err
+			}
+			var manifest ociArtifactManifest
+			if err := json.Unmarshal(artifact.Manifest, &manifest); err != nil {
+				return nil, err
+			}
+			if manifest.Subject == nil || manifest.Subject.Digest.String() != ref.DigestStr() {
+				continue
+			}
+			for _, l := range manifest.Layers {
+				if l.MediaType != dsseEnvelopeMediaType {
+					continue
+				}
+				content, err := fetchBlob(ref, l.Digest.String(), opts...)
+				if err != nil {
+					return nil, err
+				}
+				a := attachedAttestation{
+					source:  fmt.Sprintf("%s@%s", ref.Context(), m.Digest),
+					content: content,
+				}
+				if c, ok := l.Annotations[cosignCertificateAnnotation]; ok {
+					a.certificate = []byte(c + l.Annotations[cosignChainAnnotation])
+				}
+				if b, ok := l.Annotations[cosignBundleAnnotation]; ok {
+					a.bundle = []byte(b)
+				}
+				res = append(res, a)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func fetchBlob(ref name.Digest, digest string, opts ...remote.Option) ([]byte, error) {
+	layer, err := remote.Layer(ref.Context().Digest(digest), opts...)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
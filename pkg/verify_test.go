@@ -0,0 +1,382 @@
+// Copyright The SLSA team.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// failedChecks returns the names of the checks that failed.
+func failedChecks(res *VerificationResult) []string {
+	var failed []string
+	for _, c := range res.Checks {
+		if !c.Passed {
+			failed = append(failed, c.Name)
+		}
+	}
+	return failed
+}
+
+func Test_VerifyAttestation(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	image := Image{Name: "ghcr.io/org/a", Digest: testDigest1}
+	signer := newTestSigner(t)
+	publicKey, err := signer.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey: %v", err)
+	}
+	fulcio := newFakeFulcio(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(fulcio.root)
+	keyless, err := NewKeylessSigner(fulcio, testJWT(t, map[string]string{
+		"sub":              "repo:org/repo:ref:refs/tags/v1.2.3",
+		"job_workflow_ref": testJobWorkflowRef,
+	}))
+	if err != nil {
+		t.Fatalf("NewKeylessSigner: %v", err)
+	}
+	rekor := newFakeRekor(t)
+
+	attest := func(opts AttestationOptions, builderID string) Attestation {
+		opts, err := opts.normalize()
+		if err != nil {
+			t.Fatalf("normalize: %v", err)
+		}
+		opts.Mode = AttestationCombined
+		attestations, err := generateAttestations([]Image{image}, gh, []string{"ko", "publish"}, nil, BuilderInfo{ID: builderID}, opts)
+		if err != nil {
+			t.Fatalf("generateAttestations: %v", err)
+		}
+		return attestations[0]
+	}
+	signed := attest(AttestationOptions{Format: FormatStatement, Signer: signer}, testJobWorkflowRef)
+	signedV1 := attest(AttestationOptions{Format: FormatStatement, SLSAVersion: "1.0", Signer: signer}, testJobWorkflowRef)
+	signedKeyless := attest(AttestationOptions{Format: FormatStatement, Signer: keyless, Rekor: rekor}, testJobWorkflowRef)
+	loggedKey := attest(AttestationOptions{Format: FormatStatement, Signer: signer, Rekor: rekor}, testJobWorkflowRef)
+
+	// notLogged has no bundle, and expired was logged
+	// after its certificate expired.
+	notLogged := signedKeyless
+	notLogged.Bundle = nil
+	expired := signedKeyless
+	late := newFakeRekor(t)
+	late.key = rekor.key
+	late.integratedTime = time.Now().Add(time.Hour)
+	leaf, err := signerPublicKey(keyless)
+	if err != nil {
+		t.Fatalf("signerPublicKey: %v", err)
+	}
+	entry, err := newRekorIntotoEntry(signedKeyless.Content, leaf)
+	if err != nil {
+		t.Fatalf("newRekorIntotoEntry: %v", err)
+	}
+	expired.Bundle, err = late.CreateEntry(entry)
+	if err != nil {
+		t.Fatalf("CreateEntry: %v", err)
+	}
+	otherBuilder := attest(AttestationOptions{Format: FormatStatement, Signer: signer}, "org/other/.github/workflows/builder.yml@main")
+	unsigned := attest(AttestationOptions{Format: FormatStatement}, testJobWorkflowRef)
+
+	expected := VerifyOptions{
+		BuilderID:      testJobWorkflowRef,
+		SourceURI:      "github.com/org/repo",
+		SourceRef:      "refs/tags/v1.2.3",
+		PublicKey:      publicKey,
+		Roots:          roots,
+		RekorPublicKey: &rekor.key.PublicKey,
+	}
+	with := func(f func(*VerifyOptions)) VerifyOptions {
+		opts := expected
+		f(&opts)
+		return opts
+	}
+
+	tests := []struct {
+		name        string
+		attestation Attestation
+		image       Image
+		opts        VerifyOptions
+		failed      []string
+		err         error
+	}{
+		{
+			name:        "signed with a key",
+			attestation: signed,
+			image:       image,
+			opts:        expected,
+		},
+		{
+			name:        "slsa v1.0",
+			attestation: signedV1,
+			image:       image,
+			opts:        expected,
+		},
+		{
+			name:        "keyless",
+			attestation: signedKeyless,
+			image:       image,
+			opts:        expected,
+		},
+		{
+			name:        "logged with a key",
+			attestation: loggedKey,
+			image:       image,
+			opts:        expected,
+		},
+		{
+			name:        "keyless without bundle",
+			attestation: notLogged,
+			image:       image,
+			opts:        expected,
+			failed:      []string{CheckSignature},
+		},
+		{
+			name:        "keyless logged after the certificate expired",
+			attestation: expired,
+			image:       image,
+			opts:        expected,
+			failed:      []string{CheckSignature},
+		},
+		{
+			name:        "keyless other log",
+			attestation: signedKeyless,
+			image:       image,
+			opts:        with(func(o *VerifyOptions) { o.RekorPublicKey = &newFakeRekor(t).key.PublicKey }),
+			failed:      []string{CheckSignature},
+		},
+		{
+			name:        "keyless other issuer",
+			attestation: signedKeyless,
+			image:       image,
+			opts:        with(func(o *VerifyOptions) { o.Issuer = "https://issuer.example.com" }),
+			failed:      []string{CheckSignature},
+		},
+		{
+			name:        "any source ref",
+			attestation: signed,
+			image:       image,
+			opts:        with(func(o *VerifyOptions) { o.SourceRef = "" }),
+		},
+		{
+			name:        "other key",
+			attestation: signed,
+			image:       image,
+			opts: with(func(o *VerifyOptions) {
+				o.PublicKey, _ = newTestSigner(t).PublicKey()
+			}),
+			failed: []string{CheckSignature},
+		},
+		{
+			name:        "untrusted certificate",
+			attestation: signedKeyless,
+			image:       image,
+			opts:        with(func(o *VerifyOptions) { o.Roots = x509.NewCertPool() }),
+			failed:      []string{CheckSignature},
+		},
+		{
+			name:        "unsigned",
+			attestation: unsigned,
+			image:       image,
+			opts:        expected,
+			failed:      []string{CheckSignature},
+		},
+		{
+			name:        "other image",
+			attestation: signed,
+			image:       Image{Name: "ghcr.io/org/a", Digest: testDigest2},
+			opts:        expected,
+			failed:      []string{CheckSubject},
+		},
+		{
+			name:        "other builder",
+			attestation: otherBuilder,
+			image:       image,
+			opts:        expected,
+			failed:      []string{CheckBuilderID},
+		},
+		{
+			name:        "keyless other builder",
+			attestation: signedKeyless,
+			image:       image,
+			opts: with(func(o *VerifyOptions) {
+				o.BuilderID = "org/other/.github/workflows/builder.yml@main"
+			}),
+			failed: []string{CheckSignature, CheckBuilderID},
+		},
+		{
+			name:        "other source",
+			attestation: signedV1,
+			image:       image,
+			opts:        with(func(o *VerifyOptions) { o.SourceURI = "github.com/org/other" }),
+			failed:      []string{CheckConfigSource},
+		},
+		{
+			name:        "other ref",
+			attestation: signed,
+			image:       image,
+			opts:        with(func(o *VerifyOptions) { o.SourceRef = "refs/heads/main" }),
+			failed:      []string{CheckConfigSource},
+		},
+		{
+			name:        "no builder",
+			attestation: signed,
+			image:       image,
+			opts:        with(func(o *VerifyOptions) { o.BuilderID = "" }),
+			err:         errorInvalidVerifyOptions,
+		},
+		{
+			name:        "no key",
+			attestation: signed,
+			image:       image,
+			opts: with(func(o *VerifyOptions) {
+				o.PublicKey = nil
+				o.Roots = nil
+			}),
+			err: errorInvalidVerifyOptions,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var bundle []byte
+			if tt.attestation.Bundle != nil {
+				bundle, err = json.Marshal(tt.attestation.Bundle)
+				if err != nil {
+					t.Fatalf("json.Marshal: %v", err)
+				}
+			}
+			res, err := VerifyAttestation(tt.attestation.Filename, tt.attestation.Content,
+				tt.attestation.Certificate, bundle, tt.image, tt.opts)
+			if !errCmp(err, tt.err) {
+				t.Fatalf(cmp.Diff(err, tt.err))
+			}
+			if err != nil {
+				return
+			}
+
+			if diff := cmp.Diff(tt.failed, failedChecks(res)); diff != "" {
+				t.Errorf("%s\n%+v", diff, res.Checks)
+			}
+			if res.Passed != (len(tt.failed) == 0) {
+				t.Errorf("unexpected result: %v", res.Passed)
+			}
+		})
+	}
+}
+
+func Test_verifyImage(t *testing.T) {
+	t.Parallel()
+
+	gh, err := parseGitHubContext(testGitHubContext)
+	if err != nil {
+		t.Fatalf("parseGitHubContext: %v", err)
+	}
+	fulcio := newFakeFulcio(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(fulcio.root)
+	keyless, err := NewKeylessSigner(fulcio, testJWT(t, map[string]string{
+		"sub":              "repo:org/repo:ref:refs/tags/v1.2.3",
+		"job_workflow_ref": testJobWorkflowRef,
+	}))
+	if err != nil {
+		t.Fatalf("NewKeylessSigner: %v", err)
+	}
+	rekor := newFakeRekor(t)
+	opts := VerifyOptions{
+		BuilderID:      testJobWorkflowRef,
+		SourceURI:      "github.com/org/repo",
+		Roots:          roots,
+		RekorPublicKey: &rekor.key.PublicKey,
+	}
+
+	tests := []struct {
+		name    string
+		mode    AttachmentMode
+		results int
+		err     error
+	}{
+		{
+			name:    "cosign",
+			mode:    AttachCosign,
+			results: 1,
+		},
+		{
+			name:    "referrer",
+			mode:    AttachReferrer,
+			results: 1,
+		},
+		{
+			name:    "both",
+			mode:    AttachBoth,
+			results: 2,
+		},
+		{
+			name: "not attached",
+			err:  errorNoAttestation,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt // Re-initializing variable so it is not changed while executing the closure below
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			host := newTestRegistry(t)
+			image := pushRandomImage(t, host+"/org/a")
+
+			if tt.mode != "" {
+				attOpts, err := AttestationOptions{Format: FormatStatement, Signer: keyless, Rekor: rekor}.normalize()
+				if err != nil {
+					t.Fatalf("normalize: %v", err)
+				}
+				attOpts.Mode = AttestationCombined
+				attestations, err := generateAttestations([]Image{image}, gh, []string{"ko", "publish"}, nil, testBuilder, attOpts)
+				if err != nil {
+					t.Fatalf("generateAttestations: %v", err)
+				}
+				if err := attachAttestations(attestations, tt.mode); err != nil {
+					t.Fatalf("attachAttestations: %v", err)
+				}
+			}
+
+			// The tag is resolved to the image's digest.
+			results, err := verifyImage(host+"/org/a:latest", opts)
+			if !errCmp(err, tt.err) {
+				t.Fatalf(cmp.Diff(err, tt.err))
+			}
+			if len(results) != tt.results {
+				t.Fatalf("expected %d results, got %d", tt.results, len(results))
+			}
+			for _, res := range results {
+				if !res.Passed {
+					t.Errorf("%s: %+v", res.Source, res.Checks)
+				}
+			}
+		})
+	}
+}